@@ -0,0 +1,275 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+)
+
+const (
+	// PAX record identifying the format of archive entries
+	archiveFormatRecord = "CADDYREDIS.format"
+
+	// Archive entry containing the encoded StorageData as stored in Redis
+	archiveFormatRaw = "raw"
+)
+
+// ExportOptions control which keys are written by Export and how.
+type ExportOptions struct {
+	// Include exports only keys matching one of these patterns, if not empty
+	Include []string
+	// Exclude skips keys matching one of these patterns
+	Exclude []string
+	// Gzip compresses the archive
+	Gzip bool
+	// Raw writes values as stored in Redis (compressed and encrypted) instead of decoded
+	Raw bool
+}
+
+// ImportOptions control which keys are stored by Import and how.
+type ImportOptions struct {
+	// Include imports only keys matching one of these patterns, if not empty
+	Include []string
+	// Exclude skips keys matching one of these patterns
+	Exclude []string
+	// ReEncrypt re-encodes raw values using the configured compression and encryption
+	ReEncrypt bool
+	// SourceEncryptionKey decrypts raw values exported using a different encryption key, which
+	// are then re-encoded using the configured compression and encryption
+	SourceEncryptionKey string
+}
+
+// matchPathFilter reports whether key should be processed given the include and exclude patterns.
+// A pattern matches a key if it matches the key itself or one of its parent directories. Patterns
+// containing a "/" are matched against the full path, otherwise against the base name only.
+func matchPathFilter(key string, include, exclude []string) bool {
+	return (len(include) == 0 || matchPathPatterns(key, include)) && !matchPathPatterns(key, exclude)
+}
+
+// matchPathPatterns reports whether key or one of its parent directories matches any pattern.
+func matchPathPatterns(key string, patterns []string) bool {
+	for k := key; k != "." && k != "/" && k != ""; k = path.Dir(k) {
+		for _, pattern := range patterns {
+			name := k
+			if !strings.Contains(pattern, "/") {
+				name = path.Base(k)
+			}
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validatePathPatterns returns an error if any pattern is malformed.
+func validatePathPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid path pattern: %q", pattern)
+		}
+	}
+	return nil
+}
+
+// Export writes every key stored under the key prefix to w as a tar archive, preserving the
+// modification time of each value. Values are decoded unless opts.Raw is set, in which case they
+// can only be imported by a storage configured with the same encryption key. Returns the number
+// of exported keys.
+func (rs *RedisStorage) Export(ctx context.Context, w io.Writer, opts ExportOptions) (int, error) {
+
+	if err := validatePathPatterns(slices.Concat(opts.Include, opts.Exclude)); err != nil {
+		return 0, err
+	}
+
+	var gzipWriter *gzip.Writer
+	if opts.Gzip {
+		gzipWriter = gzip.NewWriter(w)
+		w = gzipWriter
+	}
+	tarWriter := tar.NewWriter(w)
+
+	var exported int
+	for key, err := range rs.ListIter(ctx, "", true) {
+		if err != nil {
+			return exported, err
+		}
+		if !matchPathFilter(key, opts.Include, opts.Exclude) {
+			continue
+		}
+
+		sd, err := rs.loadStorageData(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Deleted since listed, or stale directory record
+			continue
+		} else if err != nil {
+			return exported, err
+		}
+
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     key,
+			Mode:     0600,
+			ModTime:  sd.Modified,
+			// Preserve sub-second modification times
+			Format: tar.FormatPAX,
+		}
+
+		var data []byte
+		if opts.Raw {
+			if data, err = json.Marshal(sd); err != nil {
+				return exported, fmt.Errorf("Unable to marshal value for %s: %v", key, err)
+			}
+			header.PAXRecords = map[string]string{archiveFormatRecord: archiveFormatRaw}
+		} else if data, err = rs.decodeStorageData(key, sd); err != nil {
+			return exported, err
+		}
+		header.Size = int64(len(data))
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return exported, fmt.Errorf("Unable to write archive header for %s: %v", key, err)
+		}
+		if _, err := tarWriter.Write(data); err != nil {
+			return exported, fmt.Errorf("Unable to write archive data for %s: %v", key, err)
+		}
+		exported++
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return exported, fmt.Errorf("Unable to close archive: %v", err)
+	}
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			return exported, fmt.Errorf("Unable to close archive: %v", err)
+		}
+	}
+
+	return exported, nil
+}
+
+// Import stores every key in the tar archive read from r, optionally gzip compressed, preserving
+// the modification time of each value. Decoded values are stored using the configured compression
+// and encryption. Raw values must be readable using the configured encryption key and are stored
+// unchanged, unless opts.ReEncrypt is set. Raw values exported using a different encryption key
+// are decrypted using opts.SourceEncryptionKey and re-encoded. Returns the number of imported keys.
+func (rs *RedisStorage) Import(ctx context.Context, r io.Reader, opts ImportOptions) (int, error) {
+
+	if err := validatePathPatterns(slices.Concat(opts.Include, opts.Exclude)); err != nil {
+		return 0, err
+	}
+
+	// Detect gzip compressed archives by their magic number
+	bufReader := bufio.NewReader(r)
+	if magic, _ := bufReader.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gzipReader, err := gzip.NewReader(bufReader)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to read archive: %v", err)
+		}
+		defer gzipReader.Close()
+		r = gzipReader
+	} else {
+		r = bufReader
+	}
+	tarReader := tar.NewReader(r)
+
+	var imported int
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return imported, fmt.Errorf("Unable to read archive: %v", err)
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		// Keys must not refer to the key prefix itself or escape it
+		key := path.Clean(header.Name)
+		if path.IsAbs(key) || key == "." || key == ".." || strings.HasPrefix(key, "../") {
+			return imported, fmt.Errorf("Invalid key in archive: %s", header.Name)
+		}
+		if !matchPathFilter(key, opts.Include, opts.Exclude) {
+			continue
+		}
+
+		data, err := io.ReadAll(tarReader)
+		if err != nil {
+			return imported, fmt.Errorf("Unable to read archive data for %s: %v", key, err)
+		}
+
+		sd, err := rs.importStorageData(key, data, header, opts)
+		if err != nil {
+			return imported, err
+		}
+		if err := rs.storeStorageData(ctx, key, sd); err != nil {
+			return imported, err
+		}
+		imported++
+	}
+
+	return imported, nil
+}
+
+// importStorageData returns the encoded data to store for an archive entry.
+func (rs *RedisStorage) importStorageData(key string, data []byte, header *tar.Header, opts ImportOptions) (*StorageData, error) {
+
+	if header.PAXRecords[archiveFormatRecord] != archiveFormatRaw {
+		sd, err := rs.encodeStorageData(key, data)
+		if err != nil {
+			return nil, err
+		}
+		sd.Modified = header.ModTime
+		return sd, nil
+	}
+
+	sd, err := unmarshalStorageData(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal value for %s: %v", key, err)
+	}
+	// Ensure the value can be read using the configured or source encryption key
+	var source = rs
+	if opts.SourceEncryptionKey != "" && opts.SourceEncryptionKey != rs.EncryptionKey {
+		sourceConfig := *rs
+		sourceConfig.EncryptionKey = opts.SourceEncryptionKey
+		source = &sourceConfig
+	}
+	value, err := source.decodeStorageData(key, sd)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.ReEncrypt && source == rs {
+		return sd, nil
+	}
+
+	modified := sd.Modified
+	if sd, err = rs.encodeStorageData(key, value); err != nil {
+		return nil, err
+	}
+	sd.Modified = modified
+	return sd, nil
+}
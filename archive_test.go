@@ -0,0 +1,167 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchPathFilter(t *testing.T) {
+
+	assert.True(t, matchPathFilter(TestKeyExampleCrt, nil, nil))
+	assert.True(t, matchPathFilter(TestKeyExampleCrt, []string{TestKeyCertPath}, nil))
+	assert.True(t, matchPathFilter(TestKeyExampleCrt, []string{TestKeyCertPath + "/*/example.com"}, nil))
+	assert.False(t, matchPathFilter(TestKeyExampleCrt, []string{"ocsp"}, nil))
+	assert.False(t, matchPathFilter(TestKeyExampleCrt, nil, []string{"*.crt"}))
+	assert.False(t, matchPathFilter(TestKeyExampleCrt, []string{TestKeyCertPath}, []string{TestKeyAcmePath}))
+	assert.True(t, matchPathFilter(TestKeyExampleKey, []string{TestKeyCertPath}, []string{"*.crt"}))
+	assert.True(t, matchPathFilter(TestKeyExampleKey, []string{"example.com"}, nil))
+	assert.False(t, matchPathFilter(TestKeyExampleKey, []string{"*/example.com"}, nil))
+}
+
+func TestRedisStorage_ExportImport(t *testing.T) {
+
+	source, ctx := provisionRedisStorage(t)
+
+	values := map[string][]byte{
+		TestKeyExampleCrt:  TestValueCrt,
+		TestKeyExampleKey:  TestValueKey,
+		TestKeyExampleJson: TestValueJson,
+		"ocsp/example.com": TestValueCrt,
+	}
+	for key, value := range values {
+		err := source.Store(ctx, key, value)
+		require.NoError(t, err)
+	}
+
+	for _, gzip := range []bool{false, true} {
+
+		var archive bytes.Buffer
+		exported, err := source.Export(ctx, &archive, ExportOptions{Gzip: gzip, Exclude: []string{"*.json"}})
+		require.NoError(t, err)
+		assert.Equal(t, 3, exported)
+
+		// Decoded values can be imported using a different prefix and encryption key
+		target, _ := provisionRedisStorage(t)
+		target.KeyPrefix = "imported"
+		target.EncryptionKey = "oZO3BDDMuwC23croDwRr1aedfs5kcM8l"
+
+		imported, err := target.Import(ctx, &archive, ImportOptions{Include: []string{TestKeyCertPath}})
+		require.NoError(t, err)
+		assert.Equal(t, 2, imported)
+
+		keys, err := target.List(ctx, "", true)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{TestKeyExampleCrt, TestKeyExampleKey}, keys)
+
+		for _, key := range keys {
+			value, err := target.Load(ctx, key)
+			require.NoError(t, err)
+			assert.Equal(t, values[key], value)
+
+			sourceInfo, err := source.Stat(ctx, key)
+			require.NoError(t, err)
+			targetInfo, err := target.Stat(ctx, key)
+			require.NoError(t, err)
+			assert.True(t, sourceInfo.Modified.Equal(targetInfo.Modified))
+		}
+	}
+}
+
+func TestRedisStorage_ExportImportRaw(t *testing.T) {
+
+	source, ctx := provisionRedisStorage(t)
+	value := bytes.Repeat(TestValueCrt, 10)
+
+	err := source.Store(ctx, TestKeyExampleCrt, value)
+	require.NoError(t, err)
+
+	var archive bytes.Buffer
+	exported, err := source.Export(ctx, &archive, ExportOptions{Raw: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, exported)
+	assert.NotContains(t, archive.String(), string(value))
+
+	for _, reEncrypt := range []bool{false, true} {
+
+		target, _ := provisionRedisStorage(t)
+		target.Compression = CompressionZlib
+
+		imported, err := target.Import(ctx, bytes.NewReader(archive.Bytes()), ImportOptions{ReEncrypt: reEncrypt})
+		require.NoError(t, err)
+		assert.Equal(t, 1, imported)
+
+		loaded, err := target.Load(ctx, TestKeyExampleCrt)
+		require.NoError(t, err)
+		assert.Equal(t, value, loaded)
+
+		// Raw values are stored unchanged unless re-encrypted
+		sd, err := target.loadStorageData(ctx, TestKeyExampleCrt)
+		require.NoError(t, err)
+		if reEncrypt {
+			assert.Equal(t, storageCompressionZlib, sd.Compression)
+		} else {
+			assert.Equal(t, storageCompressionFlate, sd.Compression)
+		}
+	}
+
+	// Raw values cannot be imported using a different encryption key
+	target, _ := provisionRedisStorage(t)
+	target.EncryptionKey = "oZO3BDDMuwC23croDwRr1aedfs5kcM8l"
+	_, err = target.Import(ctx, bytes.NewReader(archive.Bytes()), ImportOptions{ReEncrypt: true})
+	assert.ErrorContains(t, err, "Unable to decrypt value")
+	assert.False(t, target.Exists(ctx, TestKeyExampleCrt))
+
+	// Raw values are moved to a new encryption key using the source encryption key
+	imported, err := target.Import(ctx, bytes.NewReader(archive.Bytes()), ImportOptions{SourceEncryptionKey: TestEncryptionKey})
+	require.NoError(t, err)
+	assert.Equal(t, 1, imported)
+
+	loaded, err := target.Load(ctx, TestKeyExampleCrt)
+	require.NoError(t, err)
+	assert.Equal(t, value, loaded)
+	sd, err := target.loadStorageData(ctx, TestKeyExampleCrt)
+	require.NoError(t, err)
+	_, err = source.decodeStorageData(TestKeyExampleCrt, sd)
+	assert.ErrorContains(t, err, "Unable to decrypt value")
+}
+
+func TestRedisStorage_ImportInvalidKeys(t *testing.T) {
+
+	for _, name := range []string{"", ".", "..", "../example.com", "/example.com", "a/../.."} {
+
+		var archive bytes.Buffer
+		tarWriter := tar.NewWriter(&archive)
+		err := tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: int64(len(TestValueCrt)), Mode: 0o600})
+		require.NoError(t, err)
+		_, err = tarWriter.Write(TestValueCrt)
+		require.NoError(t, err)
+		require.NoError(t, tarWriter.Close())
+
+		rs, ctx := provisionRedisStorage(t)
+		imported, err := rs.Import(ctx, &archive, ImportOptions{})
+		assert.ErrorContains(t, err, "Invalid key in archive", name)
+		assert.Zero(t, imported)
+
+		keys, err := rs.client.Keys(ctx, "*").Result()
+		require.NoError(t, err)
+		assert.Empty(t, keys, name)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// Name of the lock ensuring that only one node repairs the directory index at a time
+	repairLockName = "storage_redis_repair"
+
+	// Maximum interval between checks whether a background repair is due
+	repairCheckInterval = 1 * time.Minute
+
+	// Number of batches of scanned keys processed on each master node per background repair step
+	repairStepBatches = 20
+)
+
+// Fields of the hash recording the progress of background repairs
+const (
+	// Start time (unix seconds) of the last completed repair
+	repairFieldLastRun = "last_run"
+	// Start time (unix seconds) of the repair in progress
+	repairFieldStarted = "started"
+	// Prefix of the SCAN cursor of each master node, or "done" once all keys were scanned
+	repairFieldCursorPrefix = "cursor:"
+	// Number of problems fixed by the repair in progress
+	repairFieldMissing    = "missing"
+	repairFieldStale      = "stale"
+	repairFieldOrphaned   = "orphaned"
+	repairFieldUnreadable = "unreadable"
+
+	repairCursorDone = "done"
+)
+
+// backgroundRepair holds the state of the background repair goroutine.
+type backgroundRepair struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// repairStateKey returns the Redis key of the hash recording the progress of background
+// repairs, shared by all nodes using the same key prefix.
+func (rs *RedisStorage) repairStateKey() string {
+	return rs.KeyPrefix + ":repair"
+}
+
+// startBackgroundRepair periodically repairs the directory index every RepairInterval, one
+// step at a time.
+func (rs *RedisStorage) startBackgroundRepair() {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		// Check more often than the repair interval so that the node holding the lock
+		// does not determine the schedule of the other nodes
+		ticker := time.NewTicker(min(time.Duration(rs.RepairInterval), repairCheckInterval))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			if _, err := rs.runScheduledRepair(ctx, RepairOptions{}); err != nil && ctx.Err() == nil && rs.logger != nil {
+				rs.logger.Warnw("Background repair of directory index failed", "error", err)
+			}
+		}
+	}()
+
+	rs.backgroundRepair = &backgroundRepair{cancel: cancel, done: done}
+}
+
+// stopBackgroundRepair stops the background repair goroutine, if any, and waits for a
+// repair in progress to be cancelled.
+func (rs *RedisStorage) stopBackgroundRepair() {
+	if rs.backgroundRepair == nil {
+		return
+	}
+	rs.backgroundRepair.cancel()
+	<-rs.backgroundRepair.done
+	rs.backgroundRepair = nil
+}
+
+// runScheduledRepair runs the next step of an incremental repair of the directory index unless
+// another node is currently repairing it. A new repair is started once no node has completed a
+// repair within RepairInterval. Each step scans up to repairStepBatches batches of keys on every
+// master node, resuming from the SCAN cursors recorded in Redis by the previous step, and checks
+// the records of the scanned directory sets. Returns true if a repair step was run.
+func (rs *RedisStorage) runScheduledRepair(ctx context.Context, opts RepairOptions) (bool, error) {
+
+	obtained, err := rs.TryLock(ctx, repairLockName)
+	if err != nil || !obtained {
+		return false, err
+	}
+	defer func() {
+		if err := rs.Unlock(context.Background(), repairLockName); err != nil && rs.logger != nil {
+			rs.logger.Warnw("Unable to release repair lock", "error", err)
+		}
+	}()
+
+	stateKey := rs.repairStateKey()
+	state, err := rs.client.HGetAll(ctx, stateKey).Result()
+	if err != nil {
+		return false, fmt.Errorf("Unable to get repair progress: %v", err)
+	}
+
+	started, err := strconv.ParseInt(state[repairFieldStarted], 10, 64)
+	if err != nil {
+		// No repair in progress, start a new repair once due
+		lastRun, err := strconv.ParseInt(state[repairFieldLastRun], 10, 64)
+		if err == nil && time.Since(time.Unix(lastRun, 0)) < time.Duration(rs.RepairInterval) {
+			return false, nil
+		}
+		started = time.Now().Unix()
+		if err := rs.client.HSet(ctx, stateKey, repairFieldStarted, started).Err(); err != nil {
+			return false, fmt.Errorf("Unable to set repair progress: %v", err)
+		}
+		if rs.logger != nil {
+			rs.logger.Infof("Starting background repair of directory index")
+		}
+	}
+
+	run := newRepairRun(rs, opts)
+	run.incremental = true
+
+	// Scan the next batches of keys on every master node not yet completely scanned
+	var mu sync.Mutex
+	var progress = map[string]any{}
+	var done = true
+	err = rs.forEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+
+		field := repairFieldCursorPrefix + client.Options().Addr
+		if state[field] == repairCursorDone {
+			return nil
+		}
+		cursor, _ := strconv.ParseUint(state[field], 10, 64)
+
+		cursor, scanned, err := run.scanStep(ctx, client, cursor)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if scanned {
+			progress[field] = repairCursorDone
+		} else {
+			progress[field] = cursor
+			done = false
+		}
+		return nil
+	})
+	if err != nil {
+		return true, err
+	}
+
+	// The root directory set is not matched by the scan pattern
+	if done {
+		if _, err := run.repairDirectory(ctx, ""); err != nil {
+			return true, err
+		}
+	}
+
+	// Accumulate the number of problems fixed by every step of the repair
+	report := run.report
+	for field, count := range map[string]int{
+		repairFieldMissing:    len(report.MissingEntries),
+		repairFieldStale:      len(report.StaleEntries),
+		repairFieldOrphaned:   len(report.OrphanedDirectories),
+		repairFieldUnreadable: len(report.UnreadableValues),
+	} {
+		previous, _ := strconv.Atoi(state[field])
+		progress[field] = previous + count
+	}
+
+	if !done {
+		if err := rs.client.HSet(ctx, stateKey, progress).Err(); err != nil {
+			return true, fmt.Errorf("Unable to set repair progress: %v", err)
+		}
+		return true, nil
+	}
+
+	// Record the completed repair, discarding its progress
+	_, err = rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, stateKey)
+		pipe.HSet(ctx, stateKey, repairFieldLastRun, started)
+		return nil
+	})
+	if err != nil {
+		return true, fmt.Errorf("Unable to set last repair time: %v", err)
+	}
+
+	if rs.logger != nil {
+		rs.logger.Infof("Completed background repair of directory index in %s: %d missing, %d stale and %d orphaned directory records fixed, %d unreadable values",
+			time.Since(time.Unix(started, 0)).Round(time.Second), progress[repairFieldMissing], progress[repairFieldStale], progress[repairFieldOrphaned], progress[repairFieldUnreadable])
+	}
+
+	return true, nil
+}
+
+// scanStep scans up to repairStepBatches batches of keys stored on a single node starting at
+// cursor, repairing them. Returns the cursor to resume from, or true once all keys were scanned.
+func (run *repairRun) scanStep(ctx context.Context, client *redis.Client, cursor uint64) (uint64, bool, error) {
+
+	pattern := run.rs.storageKeyPattern()
+
+	for range repairStepBatches {
+		keys, nextCursor, err := client.Scan(ctx, cursor, pattern, int64(run.opts.BatchSize)).Result()
+		if err != nil {
+			return cursor, false, fmt.Errorf("Unable to scan path %s: %v", pattern, err)
+		}
+		if len(keys) > 0 {
+			if err := run.repairKeys(ctx, keys); err != nil {
+				return cursor, false, err
+			}
+		}
+
+		// End of results reached
+		if nextCursor == 0 {
+			return 0, true, nil
+		}
+		cursor = nextCursor
+	}
+
+	return cursor, false, nil
+}
@@ -0,0 +1,187 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisStorage_RunScheduledRepair(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+	rs.RepairInterval = caddy.Duration(time.Hour)
+
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	require.NoError(t, err)
+
+	// Corrupt the directory index
+	err = rs.client.ZRem(ctx, rs.prefixKey(TestKeyExamplePath), "example.com.crt").Err()
+	require.NoError(t, err)
+
+	// Another node is repairing the index
+	obtained, err := rs.TryLock(ctx, repairLockName)
+	require.NoError(t, err)
+	require.True(t, obtained)
+
+	repaired, err := rs.runScheduledRepair(ctx, RepairOptions{})
+	assert.NoError(t, err)
+	assert.False(t, repaired)
+
+	err = rs.Unlock(ctx, repairLockName)
+	require.NoError(t, err)
+
+	repaired, err = rs.runScheduledRepair(ctx, RepairOptions{})
+	assert.NoError(t, err)
+	assert.True(t, repaired)
+
+	keys, err := rs.List(ctx, TestKeyExamplePath, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{TestKeyExampleCrt}, keys)
+
+	lastRun, err := rs.client.HGet(ctx, rs.repairStateKey(), repairFieldLastRun).Int64()
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), time.Unix(lastRun, 0), time.Minute)
+
+	// A repair was completed within the current interval
+	repaired, err = rs.runScheduledRepair(ctx, RepairOptions{})
+	assert.NoError(t, err)
+	assert.False(t, repaired)
+
+	// The repair lock was released
+	obtained, err = rs.TryLock(ctx, repairLockName)
+	assert.NoError(t, err)
+	assert.True(t, obtained)
+	err = rs.Unlock(ctx, repairLockName)
+	assert.NoError(t, err)
+}
+
+func TestRedisStorage_RunScheduledRepairSteps(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+	rs.RepairInterval = caddy.Duration(time.Hour)
+
+	var stored []string
+	for i := range 3 * repairStepBatches {
+		key := fmt.Sprintf("%s/domain%02d.com/domain%02d.com.crt", TestKeyAcmePath, i, i)
+		err := rs.Store(ctx, key, TestValueCrt)
+		require.NoError(t, err)
+		stored = append(stored, key)
+	}
+
+	// Corrupt the directory index
+	err := rs.client.Del(ctx, rs.prefixKey(TestKeyAcmePath)).Err()
+	require.NoError(t, err)
+	err = rs.client.ZAdd(ctx, rs.prefixKey(TestKeyAcmePath), redis.Z{Score: 1, Member: "stale.com/"}).Err()
+	require.NoError(t, err)
+	err = rs.client.ZAdd(ctx, rs.prefixKey(""), redis.Z{Score: 1, Member: "stale/"}).Err()
+	require.NoError(t, err)
+
+	// Every step resumes the scan where the previous step stopped
+	opts := RepairOptions{BatchSize: 1}
+	var steps int
+	for {
+		repaired, err := rs.runScheduledRepair(ctx, opts)
+		require.NoError(t, err)
+		if !repaired {
+			break
+		}
+		steps++
+		require.Less(t, steps, 20)
+
+		if rs.client.HExists(ctx, rs.repairStateKey(), repairFieldStarted).Val() {
+			assert.False(t, rs.client.HExists(ctx, rs.repairStateKey(), repairFieldLastRun).Val())
+		}
+	}
+	assert.Greater(t, steps, 1)
+
+	keys, err := rs.List(ctx, "", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, stored, keys)
+
+	report, err := rs.RepairWithOptions(ctx, "", RepairOptions{DryRun: true})
+	require.NoError(t, err)
+	assert.Empty(t, report.MissingEntries)
+	assert.Empty(t, report.StaleEntries)
+
+	// Only the completion time of the repair remains recorded
+	state, err := rs.client.HGetAll(ctx, rs.repairStateKey()).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []string{repairFieldLastRun}, slices.Collect(maps.Keys(state)))
+}
+
+func TestRedisStorage_BackgroundRepair(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+	rs.RepairInterval = caddy.Duration(20 * time.Millisecond)
+
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	require.NoError(t, err)
+	err = rs.client.ZRem(ctx, rs.prefixKey(TestKeyExamplePath), "example.com.crt").Err()
+	require.NoError(t, err)
+
+	rs.startBackgroundRepair()
+
+	assert.Eventually(t, func() bool {
+		return rs.client.HExists(ctx, rs.repairStateKey(), repairFieldLastRun).Val()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	rs.stopBackgroundRepair()
+	assert.Nil(t, rs.backgroundRepair)
+
+	keys, err := rs.List(ctx, TestKeyExamplePath, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{TestKeyExampleCrt}, keys)
+}
+
+func TestRedisStorage_ProvisionBackgroundTasks(t *testing.T) {
+
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	provision := func(ctx context.Context) *RedisStorage {
+		caddyCtx, cancel := caddy.NewContext(caddy.Context{Context: ctx})
+		t.Cleanup(cancel)
+
+		rs := New()
+		rs.Address = []string{mr.Addr()}
+		rs.KeyPrefix = TestKeyPrefix
+		rs.RepairInterval = caddy.Duration(time.Hour)
+		rs.KeyspaceNotifications = true
+		require.NoError(t, rs.Provision(caddyCtx))
+		t.Cleanup(func() { _ = rs.Cleanup() })
+		return rs
+	}
+
+	rs := provision(context.Background())
+	assert.NotNil(t, rs.backgroundRepair)
+	assert.NotNil(t, rs.keyspaceSubscriber)
+
+	// Storage loaded by command line subcommands never runs background tasks
+	rs = provision(withoutBackgroundTasks(context.Background()))
+	assert.Nil(t, rs.backgroundRepair)
+	assert.Nil(t, rs.keyspaceSubscriber)
+}
@@ -16,36 +16,20 @@ package storageredis
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net"
-	"reflect"
+	"os"
 	"strconv"
 	"strings"
-
-	"github.com/spf13/cobra"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
-	caddycmd "github.com/caddyserver/caddy/v2/cmd"
 	"github.com/caddyserver/certmagic"
 )
 
 func init() {
 	caddy.RegisterModule(RedisStorage{})
-	caddycmd.RegisterCommand(caddycmd.Command{
-		Name:  "redis",
-		Short: "Commands for working with the Caddy Redis Storage module",
-		CobraFunc: func(cmd *cobra.Command) {
-			rebuildCmd := &cobra.Command{
-				Use:   "repair --config <path>",
-				Short: "Repair the Redis Storage directory index tree",
-				RunE:  caddycmd.WrapCommandFuncForCobra(cmdRedisStorageRepair),
-			}
-			rebuildCmd.Flags().StringP("config", "c", "", "Caddy configuration file (optional)")
-			cmd.AddCommand(rebuildCmd)
-		},
-	})
 }
 
 func (RedisStorage) CaddyModule() caddy.ModuleInfo {
@@ -79,6 +63,14 @@ func (rs *RedisStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			configKey := d.Val()
 			var configVal []string
 
+			// TTL patterns take a pattern and duration, either inline or as a block of pairs
+			if configKey == "ttl" {
+				if err := rs.unmarshalTTL(d); err != nil {
+					return err
+				}
+				continue
+			}
+
 			if d.NextArg() {
 				// configuration item with single parameter
 				configVal = append(configVal, d.Val())
@@ -126,6 +118,14 @@ func (rs *RedisStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				}
 			case "encryption_key", "aes_key":
 				rs.EncryptionKey = configVal[0]
+			case "encryption_algorithm":
+				rs.EncryptionAlgorithm = EncryptionAlgorithm(configVal[0])
+			case "encrypt_key_names":
+				encryptKeyNames, err := strconv.ParseBool(configVal[0])
+				if err != nil {
+					return d.Errf("invalid boolean value for 'encrypt_key_names': %s", configVal[0])
+				}
+				rs.EncryptKeyNames = encryptKeyNames
 			case "compression":
 				// Accept legacy bool values (true/false, 1/0, t/f, etc.) for backwards
 				// compatibility, mapping true → "flate". If ParseBool fails, expect one
@@ -138,12 +138,38 @@ func (rs *RedisStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					}
 				} else {
 					switch CompressionMode(configVal[0]) {
-					case CompressionFlate, CompressionZlib:
+					case CompressionFlate, CompressionZlib, CompressionZstd:
 						rs.Compression = CompressionMode(configVal[0])
 					default:
-						return d.Errf("invalid value for 'compression': %s (expected 'true', 'flate', 'zlib', or 'false')", configVal[0])
+						return d.Errf("invalid value for 'compression': %s (expected 'true', 'flate', 'zlib', 'zstd', or 'false')", configVal[0])
 					}
 				}
+			case "compression_level":
+				rs.CompressionLevel = configVal[0]
+			case "compression_dictionary":
+				rs.CompressionDictionary = configVal[0]
+			case "compression_min_size":
+				rs.CompressionMinSize = configVal[0]
+			case "max_value_size":
+				rs.MaxValueSize = configVal[0]
+			case "list_page_size":
+				rs.ListPageSize = configVal[0]
+			case "value_format":
+				rs.ValueFormat = ValueFormat(configVal[0])
+			case "storage_layout":
+				rs.StorageLayout = StorageLayout(configVal[0])
+			case "keyspace_notifications":
+				keyspaceNotifications, err := strconv.ParseBool(configVal[0])
+				if err != nil {
+					return d.Errf("invalid boolean value for 'keyspace_notifications': %s", configVal[0])
+				}
+				rs.KeyspaceNotifications = keyspaceNotifications
+			case "repair_interval":
+				repairInterval, err := caddy.ParseDuration(configVal[0])
+				if err != nil {
+					return d.Errf("invalid duration value for 'repair_interval': %s", configVal[0])
+				}
+				rs.RepairInterval = caddy.Duration(repairInterval)
 			case "tls_enabled":
 				TlsEnabledParse, err := strconv.ParseBool(configVal[0])
 				if err != nil {
@@ -184,6 +210,50 @@ func (rs *RedisStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// unmarshalTTL parses a "ttl" directive, either "ttl <pattern> <duration>" or a block
+// containing one "<pattern> <duration>" pair per line.
+func (rs *RedisStorage) unmarshalTTL(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	if len(args) > 0 {
+		if len(args) != 2 {
+			return d.ArgErr()
+		}
+		return rs.appendTTL(d, args[0], args[1])
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		pattern := d.Val()
+		args := d.RemainingArgs()
+		if len(args) != 1 {
+			return d.ArgErr()
+		}
+		if err := rs.appendTTL(d, pattern, args[0]); err != nil {
+			return err
+		}
+	}
+	if len(rs.TTL) == 0 {
+		return d.Errf("no value supplied for configuraton key 'ttl'")
+	}
+	return nil
+}
+
+func (rs *RedisStorage) appendTTL(d *caddyfile.Dispenser, pattern, duration string) error {
+	ttl, err := caddy.ParseDuration(duration)
+	if err != nil {
+		return d.Errf("invalid duration value for 'ttl' pattern %q: %s", pattern, duration)
+	}
+	rs.TTL = append(rs.TTL, KeyTTL{Pattern: pattern, TTL: caddy.Duration(ttl)})
+	return nil
+}
+
+// backgroundTasksDisabledKey marks contexts in which Provision must not start background tasks,
+// such as the contexts of command line subcommands.
+type backgroundTasksDisabledKey struct{}
+
+// withoutBackgroundTasks returns a context in which Provision does not start background tasks.
+func withoutBackgroundTasks(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundTasksDisabledKey{}, true)
+}
+
 // Provision module function called by Caddy Server
 func (rs *RedisStorage) Provision(ctx caddy.Context) error {
 
@@ -191,11 +261,27 @@ func (rs *RedisStorage) Provision(ctx caddy.Context) error {
 
 	// Abstract this logic for testing purposes
 	err := rs.finalizeConfiguration(ctx)
-	if err == nil {
-		rs.logger.Infof("Provision Redis %s storage using address %v", rs.ClientType, rs.Address)
+	if err != nil {
+		return err
+	}
+	rs.logger.Infof("Provision Redis %s storage using address %v", rs.ClientType, rs.Address)
+
+	// Background tasks only run in long-running Caddy instances
+	if disabled, _ := ctx.Value(backgroundTasksDisabledKey{}).(bool); disabled {
+		return nil
+	}
+
+	if rs.KeyspaceNotifications {
+		if err := rs.startKeyspaceNotifications(); err != nil {
+			return err
+		}
 	}
 
-	return err
+	if rs.RepairInterval > 0 {
+		rs.startBackgroundRepair()
+	}
+
+	return nil
 }
 
 func (rs *RedisStorage) finalizeConfiguration(ctx context.Context) error {
@@ -256,6 +342,24 @@ func (rs *RedisStorage) finalizeConfiguration(ctx context.Context) error {
 		}
 	}
 
+	switch EncryptionAlgorithm(repl.ReplaceAll(string(rs.EncryptionAlgorithm), "")) {
+	case "", EncryptionAESGCM:
+		rs.EncryptionAlgorithm = EncryptionAESGCM
+	case EncryptionXChaCha20Poly1305:
+		rs.EncryptionAlgorithm = EncryptionXChaCha20Poly1305
+	default:
+		return fmt.Errorf("invalid encryption_algorithm value: %q (expected 'aes-gcm' or 'xchacha20-poly1305')", rs.EncryptionAlgorithm)
+	}
+
+	if rs.EncryptKeyNames {
+		if rs.EncryptionKey == "" {
+			return fmt.Errorf("'encryption_key' is required when 'encrypt_key_names' is enabled")
+		}
+		if err := rs.initKeyNameCipher(); err != nil {
+			return err
+		}
+	}
+
 	rs.TlsServerCertsPEM = repl.ReplaceAll(rs.TlsServerCertsPEM, "")
 	rs.TlsServerCertsPath = repl.ReplaceAll(rs.TlsServerCertsPath, "")
 
@@ -266,8 +370,76 @@ func (rs *RedisStorage) finalizeConfiguration(ctx context.Context) error {
 		rs.Compression = CompressionFlate
 	case CompressionZlib:
 		rs.Compression = CompressionZlib
+	case CompressionZstd:
+		rs.Compression = CompressionZstd
+	default:
+		return fmt.Errorf("invalid compression value: %q (expected 'flate', 'zlib', 'zstd', or 'false')", rs.Compression)
+	}
+
+	rs.CompressionLevel = repl.ReplaceAll(rs.CompressionLevel, "")
+	if err := rs.validateCompressionLevel(); err != nil {
+		return err
+	}
+
+	if rs.CompressionMinSize = repl.ReplaceAll(rs.CompressionMinSize, ""); rs.CompressionMinSize != "" {
+		minSize, err := strconv.Atoi(rs.CompressionMinSize)
+		if err != nil || minSize < 0 {
+			return fmt.Errorf("invalid compression_min_size value: %s", rs.CompressionMinSize)
+		}
+	}
+
+	if rs.MaxValueSize = repl.ReplaceAll(rs.MaxValueSize, ""); rs.MaxValueSize != "" {
+		maxSize, err := strconv.ParseInt(rs.MaxValueSize, 10, 64)
+		if err != nil || maxSize <= 0 {
+			return fmt.Errorf("invalid max_value_size value: %s", rs.MaxValueSize)
+		}
+	}
+
+	if rs.ListPageSize = repl.ReplaceAll(rs.ListPageSize, ""); rs.ListPageSize != "" {
+		pageSize, err := strconv.ParseInt(rs.ListPageSize, 10, 64)
+		if err != nil || pageSize <= 0 {
+			return fmt.Errorf("invalid list_page_size value: %s", rs.ListPageSize)
+		}
+	}
+
+	if rs.CompressionDictionary = repl.ReplaceAll(rs.CompressionDictionary, ""); rs.CompressionDictionary != "" {
+		if rs.Compression != CompressionZstd {
+			return fmt.Errorf("'compression_dictionary' is only supported with 'zstd' compression")
+		}
+		dict, err := os.ReadFile(rs.CompressionDictionary)
+		if err != nil {
+			return fmt.Errorf("Failed to load compression dictionary from file %s: %v", rs.CompressionDictionary, err)
+		}
+		rs.compressionDictionary = dict
+		if err := rs.validateCompressionDictionary(); err != nil {
+			return err
+		}
+	}
+
+	switch ValueFormat(repl.ReplaceAll(string(rs.ValueFormat), "")) {
+	case "", ValueFormatBinary:
+		rs.ValueFormat = ValueFormatBinary
+	case ValueFormatJSON:
+		rs.ValueFormat = ValueFormatJSON
+	default:
+		return fmt.Errorf("invalid value_format value: %q (expected 'binary' or 'json')", rs.ValueFormat)
+	}
+
+	switch StorageLayout(repl.ReplaceAll(string(rs.StorageLayout), "")) {
+	case "", StorageLayoutString:
+		rs.StorageLayout = StorageLayoutString
+	case StorageLayoutHash:
+		rs.StorageLayout = StorageLayoutHash
 	default:
-		return fmt.Errorf("invalid compression value: %q (expected 'flate', 'zlib', or 'false')", rs.Compression)
+		return fmt.Errorf("invalid storage_layout value: %q (expected 'string' or 'hash')", rs.StorageLayout)
+	}
+
+	if err := rs.validateTTL(); err != nil {
+		return err
+	}
+
+	if rs.RepairInterval < 0 {
+		return fmt.Errorf("invalid repair_interval value: %s (must not be negative)", time.Duration(rs.RepairInterval))
 	}
 
 	rs.DB = DBIndex(repl.ReplaceAll(string(rs.DB), defaultDb))
@@ -277,6 +449,8 @@ func (rs *RedisStorage) finalizeConfiguration(ctx context.Context) error {
 	}
 
 	// TODO: these are non-string fields so they can't easily be substituted at runtime :(
+	// rs.EncryptKeyNames
+	// rs.KeyspaceNotifications
 	// rs.TlsEnabled
 	// rs.TlsInsecure
 	// rs.RouteByLatency
@@ -326,6 +500,10 @@ func normalizeKeyPrefix(prefix string) (string, error) {
 }
 
 func (rs *RedisStorage) Cleanup() error {
+	// Stop background tasks before closing the connection
+	rs.stopKeyspaceNotifications()
+	rs.stopBackgroundRepair()
+
 	// Close the Redis connection
 	if rs.client != nil {
 		rs.client.Close()
@@ -334,47 +512,6 @@ func (rs *RedisStorage) Cleanup() error {
 	return nil
 }
 
-type storageConfig struct {
-	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
-}
-
-func cmdRedisStorageRepair(fl caddycmd.Flags) (int, error) {
-
-	configFile := fl.String("config")
-
-	// Load configuration file (if not specified, will look in usual locations)
-	cfg, _, _, err := caddycmd.LoadConfig(configFile, "")
-	if err != nil {
-		return caddy.ExitCodeFailedStartup, fmt.Errorf("Unable to load config file: %v", err)
-	}
-
-	// Unmarshall the storage configuration into a temporary struct
-	var storeCfg storageConfig
-	if err := json.Unmarshal(cfg, &storeCfg); err != nil || storeCfg.StorageRaw == nil {
-		return caddy.ExitCodeFailedStartup, fmt.Errorf("Unable to unmarshal configuration: %v", err)
-	}
-
-	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
-	defer cancel()
-
-	// Load module
-	module, err := ctx.LoadModule(&storeCfg, "StorageRaw")
-	if err != nil {
-		return caddy.ExitCodeFailedStartup, err
-	}
-	// Ensure loaded module is the correct type
-	if reflect.TypeOf(module) != reflect.TypeFor[*RedisStorage]() {
-		return caddy.ExitCodeFailedStartup, fmt.Errorf("Loaded storage module does not support Redis")
-	}
-
-	rs := module.(*RedisStorage)
-	if err := rs.Repair(ctx, ""); err != nil {
-		return caddy.ExitCodeFailedStartup, err
-	}
-
-	return caddy.ExitCodeSuccess, nil
-}
-
 // Interface guards
 var (
 	_ caddy.CleanerUpper     = (*RedisStorage)(nil)
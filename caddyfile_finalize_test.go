@@ -19,8 +19,10 @@ import (
 	"net"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis/v2"
+	"github.com/caddyserver/caddy/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -98,6 +100,16 @@ func TestFinalizeConfiguration_CompressionPlaceholder(t *testing.T) {
 		assert.Equal(t, CompressionZlib, rs.Compression)
 	})
 
+	t.Run("zstd placeholder resolved", func(t *testing.T) {
+		rs, mr := newFinalizeTestStorage(t)
+		rs.Address = []string{mr.Addr()}
+		rs.Compression = CompressionMode("zstd")
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, CompressionZstd, rs.Compression)
+	})
+
 	t.Run("false string normalised to none", func(t *testing.T) {
 		rs, mr := newFinalizeTestStorage(t)
 		rs.Address = []string{mr.Addr()}
@@ -118,6 +130,212 @@ func TestFinalizeConfiguration_CompressionPlaceholder(t *testing.T) {
 	})
 }
 
+func TestFinalizeConfiguration_CompressionLevelAndDictionary(t *testing.T) {
+	t.Parallel()
+
+	t.Run("valid zstd level accepted", func(t *testing.T) {
+		rs, mr := newFinalizeTestStorage(t)
+		rs.Address = []string{mr.Addr()}
+		rs.Compression = CompressionZstd
+		rs.CompressionLevel = "19"
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 19, rs.compressionLevel())
+	})
+
+	t.Run("out of range level rejected", func(t *testing.T) {
+		rs := New()
+		rs.Compression = CompressionFlate
+		rs.CompressionLevel = "19"
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid compression_level value")
+	})
+
+	t.Run("dictionary requires zstd", func(t *testing.T) {
+		rs := New()
+		rs.Compression = CompressionFlate
+		rs.CompressionDictionary = "/path/to/dictionary"
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "only supported with 'zstd' compression")
+	})
+
+	t.Run("missing dictionary file rejected", func(t *testing.T) {
+		rs := New()
+		rs.Compression = CompressionZstd
+		rs.CompressionDictionary = "/nonexistent/dictionary"
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "Failed to load compression dictionary")
+	})
+}
+
+func TestFinalizeConfiguration_SizeLimits(t *testing.T) {
+	t.Parallel()
+
+	t.Run("valid sizes accepted", func(t *testing.T) {
+		rs, mr := newFinalizeTestStorage(t)
+		rs.Address = []string{mr.Addr()}
+		rs.CompressionMinSize = "256"
+		rs.MaxValueSize = "16777216"
+		rs.ListPageSize = "5000"
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 256, rs.compressionMinSize())
+		assert.Equal(t, int64(16777216), rs.maxValueSize())
+		assert.Equal(t, int64(5000), rs.listPageSize())
+	})
+
+	t.Run("negative compression_min_size rejected", func(t *testing.T) {
+		rs := New()
+		rs.CompressionMinSize = "-1"
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid compression_min_size value")
+	})
+
+	t.Run("zero max_value_size rejected", func(t *testing.T) {
+		rs := New()
+		rs.MaxValueSize = "0"
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid max_value_size value")
+	})
+
+	t.Run("zero list_page_size rejected", func(t *testing.T) {
+		rs := New()
+		rs.ListPageSize = "0"
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid list_page_size value")
+	})
+}
+
+func TestFinalizeConfiguration_ValueFormat(t *testing.T) {
+	t.Parallel()
+
+	t.Run("empty defaults to binary", func(t *testing.T) {
+		rs, mr := newFinalizeTestStorage(t)
+		rs.Address = []string{mr.Addr()}
+		rs.ValueFormat = ""
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, ValueFormatBinary, rs.ValueFormat)
+	})
+
+	t.Run("json accepted", func(t *testing.T) {
+		rs, mr := newFinalizeTestStorage(t)
+		rs.Address = []string{mr.Addr()}
+		rs.ValueFormat = ValueFormat("json")
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, ValueFormatJSON, rs.ValueFormat)
+	})
+
+	t.Run("invalid format rejected", func(t *testing.T) {
+		rs := New()
+		rs.ValueFormat = ValueFormat("msgpack")
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid value_format value")
+	})
+}
+
+func TestFinalizeConfiguration_StorageLayout(t *testing.T) {
+	t.Parallel()
+
+	t.Run("empty defaults to string", func(t *testing.T) {
+		rs, mr := newFinalizeTestStorage(t)
+		rs.Address = []string{mr.Addr()}
+		rs.StorageLayout = ""
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, StorageLayoutString, rs.StorageLayout)
+	})
+
+	t.Run("hash accepted", func(t *testing.T) {
+		rs, mr := newFinalizeTestStorage(t)
+		rs.Address = []string{mr.Addr()}
+		rs.StorageLayout = StorageLayout("hash")
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, StorageLayoutHash, rs.StorageLayout)
+	})
+
+	t.Run("invalid layout rejected", func(t *testing.T) {
+		rs := New()
+		rs.StorageLayout = StorageLayout("list")
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid storage_layout value")
+	})
+}
+
+func TestFinalizeConfiguration_TTL(t *testing.T) {
+	t.Parallel()
+
+	t.Run("valid patterns accepted", func(t *testing.T) {
+		rs, mr := newFinalizeTestStorage(t)
+		rs.Address = []string{mr.Addr()}
+		rs.TTL = []KeyTTL{
+			{Pattern: "ocsp/*", TTL: caddy.Duration(7 * 24 * time.Hour)},
+			{Pattern: "certificates/*/*/*.json", TTL: caddy.Duration(time.Hour)},
+		}
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 7*24*time.Hour, rs.keyTTL("ocsp/example.com-abc"))
+		assert.Equal(t, time.Hour, rs.keyTTL("certificates/acme/example.com/example.com.json"))
+		assert.Zero(t, rs.keyTTL("certificates/acme/example.com/example.com.crt"))
+	})
+
+	t.Run("invalid pattern rejected", func(t *testing.T) {
+		rs := New()
+		rs.TTL = []KeyTTL{{Pattern: "ocsp/[", TTL: caddy.Duration(time.Hour)}}
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid ttl pattern")
+	})
+
+	t.Run("non-positive ttl rejected", func(t *testing.T) {
+		rs := New()
+		rs.TTL = []KeyTTL{{Pattern: "ocsp/*", TTL: 0}}
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid ttl value")
+	})
+}
+
+func TestFinalizeConfiguration_RepairInterval(t *testing.T) {
+	t.Parallel()
+
+	t.Run("negative interval rejected", func(t *testing.T) {
+		rs := New()
+		rs.RepairInterval = caddy.Duration(-time.Hour)
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid repair_interval value")
+	})
+}
+
 func TestFinalizeConfiguration_DBPlaceholder(t *testing.T) {
 	t.Parallel()
 
@@ -217,6 +435,63 @@ func TestFinalizeConfiguration_EncryptionKeyBoundaries(t *testing.T) {
 	})
 }
 
+func TestFinalizeConfiguration_EncryptionAlgorithm(t *testing.T) {
+	t.Parallel()
+
+	t.Run("empty defaults to aes-gcm", func(t *testing.T) {
+		rs, mr := newFinalizeTestStorage(t)
+		rs.Address = []string{mr.Addr()}
+		rs.EncryptionAlgorithm = ""
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, EncryptionAESGCM, rs.EncryptionAlgorithm)
+	})
+
+	t.Run("xchacha20-poly1305 accepted", func(t *testing.T) {
+		rs, mr := newFinalizeTestStorage(t)
+		rs.Address = []string{mr.Addr()}
+		rs.EncryptionAlgorithm = EncryptionAlgorithm("xchacha20-poly1305")
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, EncryptionXChaCha20Poly1305, rs.EncryptionAlgorithm)
+	})
+
+	t.Run("invalid algorithm rejected", func(t *testing.T) {
+		rs := New()
+		rs.EncryptionAlgorithm = EncryptionAlgorithm("des")
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid encryption_algorithm value")
+	})
+}
+
+func TestFinalizeConfiguration_EncryptKeyNames(t *testing.T) {
+	t.Parallel()
+
+	t.Run("requires encryption_key", func(t *testing.T) {
+		rs := New()
+		rs.EncryptKeyNames = true
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "'encryption_key' is required")
+	})
+
+	t.Run("initializes key name cipher", func(t *testing.T) {
+		rs, mr := newFinalizeTestStorage(t)
+		rs.Address = []string{mr.Addr()}
+		rs.EncryptionKey = "12345678901234567890123456789012"
+		rs.EncryptKeyNames = true
+
+		err := rs.finalizeConfiguration(context.Background())
+		require.NoError(t, err)
+		assert.NotNil(t, rs.keyNameCipher)
+	})
+}
+
 func TestFinalizeConfiguration_TimeoutValidation(t *testing.T) {
 	t.Parallel()
 
@@ -39,6 +39,7 @@ func TestCompressionModeUnmarshalJSON(t *testing.T) {
 		// String form — raw value stored; finalizeConfiguration normalises "false" → CompressionNone
 		{name: "string flate", input: `"flate"`, expected: CompressionFlate},
 		{name: "string zlib", input: `"zlib"`, expected: CompressionZlib},
+		{name: "string zstd", input: `"zstd"`, expected: CompressionZstd},
 		{name: "string false stored as-is", input: `"false"`, expected: CompressionMode("false")},
 		{name: "empty string → none", input: `""`, expected: CompressionNone},
 		// Invalid
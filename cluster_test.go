@@ -0,0 +1,230 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bsm/redislock"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// provisionClusterRedisStorage returns a storage using a cluster client whose hash slots are
+// split between two Redis servers, so that stored keys are distributed across both nodes.
+func provisionClusterRedisStorage(t *testing.T) (*RedisStorage, context.Context, []*miniredis.Miniredis) {
+	t.Helper()
+
+	rs, ctx := provisionRedisStorage(t)
+
+	nodes := []*miniredis.Miniredis{miniredis.RunT(t), miniredis.RunT(t)}
+	clusterClient := redis.NewClusterClient(&redis.ClusterOptions{
+		ClusterSlots: func(ctx context.Context) ([]redis.ClusterSlot, error) {
+			return []redis.ClusterSlot{
+				{Start: 0, End: 8191, Nodes: []redis.ClusterNode{{Addr: nodes[0].Addr()}}},
+				{Start: 8192, End: 16383, Nodes: []redis.ClusterNode{{Addr: nodes[1].Addr()}}},
+			}, nil
+		},
+	})
+
+	require.NoError(t, rs.client.Close())
+	rs.client = clusterClient
+	rs.locker = redislock.New(clusterClient)
+
+	return rs, ctx, nodes
+}
+
+// provisionFailoverRedisStorage returns a storage using a cluster client whose hash slots are all
+// served by a single Redis server, as created for the failover client type.
+func provisionFailoverRedisStorage(t *testing.T) (*RedisStorage, context.Context) {
+	t.Helper()
+
+	rs, ctx := provisionRedisStorage(t)
+	rs.ClientType = "failover"
+
+	node := miniredis.RunT(t)
+	clusterClient := redis.NewClusterClient(&redis.ClusterOptions{
+		ClusterSlots: func(ctx context.Context) ([]redis.ClusterSlot, error) {
+			return []redis.ClusterSlot{
+				{Start: 0, End: 16383, Nodes: []redis.ClusterNode{{Addr: node.Addr()}}},
+			}, nil
+		},
+	})
+
+	require.NoError(t, rs.client.Close())
+	rs.client = clusterClient
+	rs.locker = redislock.New(clusterClient)
+
+	return rs, ctx
+}
+
+func TestRedisStorage_FailoverStore(t *testing.T) {
+
+	rs, ctx := provisionFailoverRedisStorage(t)
+	rs.TTL = []KeyTTL{{Pattern: "ocsp/*", TTL: caddy.Duration(time.Hour)}}
+
+	// Values and their directory sets are stored in different hash slots
+	for _, key := range []string{TestKeyExampleCrt, "ocsp/example.com"} {
+		err := rs.Store(ctx, key, TestValueCrt)
+		require.NoError(t, err)
+
+		value, err := rs.Load(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, TestValueCrt, value)
+	}
+
+	keys, err := rs.List(ctx, "", true)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{TestKeyExampleCrt, "ocsp/example.com"}, keys)
+}
+
+func TestRedisStorage_ClusterRepair(t *testing.T) {
+
+	rs, ctx, nodes := provisionClusterRedisStorage(t)
+
+	var stored []string
+	for i := range 20 {
+		key := fmt.Sprintf("%s/domain%02d.com/domain%02d.com.crt", TestKeyAcmePath, i, i)
+		err := rs.Store(ctx, key, TestValueCrt)
+		require.NoError(t, err)
+		stored = append(stored, key)
+	}
+
+	// Stored keys are distributed across both nodes
+	for _, node := range nodes {
+		assert.NotEmpty(t, node.Keys())
+	}
+
+	// Remove the entire directory index from every node
+	for _, node := range nodes {
+		for _, key := range node.Keys() {
+			if node.Type(key) == "zset" {
+				node.Del(key)
+			}
+		}
+	}
+	keys, err := rs.List(ctx, "", true)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	report, err := rs.RepairWithOptions(ctx, "", RepairOptions{})
+	require.NoError(t, err)
+	assert.NotEmpty(t, report.MissingEntries)
+
+	keys, err = rs.List(ctx, "", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, stored, keys)
+}
+
+func TestRedisStorage_ClusterScheduledRepair(t *testing.T) {
+
+	rs, ctx, nodes := provisionClusterRedisStorage(t)
+	rs.RepairInterval = caddy.Duration(time.Hour)
+
+	var stored []string
+	for i := range 2 * repairStepBatches {
+		key := fmt.Sprintf("%s/domain%02d.com/domain%02d.com.crt", TestKeyAcmePath, i, i)
+		err := rs.Store(ctx, key, TestValueCrt)
+		require.NoError(t, err)
+		stored = append(stored, key)
+	}
+
+	// Remove the entire directory index from every node
+	for _, node := range nodes {
+		for _, key := range node.Keys() {
+			if node.Type(key) == "zset" {
+				node.Del(key)
+			}
+		}
+	}
+
+	// The scan of every node is resumed by each step until all nodes are scanned
+	var steps int
+	for {
+		repaired, err := rs.runScheduledRepair(ctx, RepairOptions{BatchSize: 1})
+		require.NoError(t, err)
+		if !repaired {
+			break
+		}
+		steps++
+		require.Less(t, steps, 20)
+	}
+	assert.Greater(t, steps, 1)
+
+	keys, err := rs.List(ctx, "", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, stored, keys)
+}
+
+func TestRedisStorage_ClusterMigrateLayout(t *testing.T) {
+
+	rs, ctx, _ := provisionClusterRedisStorage(t)
+
+	for i := range 20 {
+		err := rs.Store(ctx, fmt.Sprintf("%s/domain%02d.com.crt", TestKeyExamplePath, i), TestValueCrt)
+		require.NoError(t, err)
+	}
+
+	rs.StorageLayout = StorageLayoutHash
+	migrated, err := rs.MigrateLayout(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 20, migrated)
+
+	for i := range 20 {
+		key := rs.prefixKey(fmt.Sprintf("%s/domain%02d.com.crt", TestKeyExamplePath, i))
+		assert.Equal(t, "hash", rs.client.Type(ctx, key).Val())
+	}
+}
+
+func TestRedisStorage_ClusterDeleteDirectory(t *testing.T) {
+
+	rs, ctx, nodes := provisionClusterRedisStorage(t)
+
+	for i := range 20 {
+		key := fmt.Sprintf("%s/domain%02d.com/domain%02d.com.crt", TestKeyAcmePath, i, i)
+		err := rs.Store(ctx, key, TestValueCrt)
+		require.NoError(t, err)
+	}
+
+	// Keys stored on different nodes are deleted in separate transactions
+	err := rs.Delete(ctx, TestKeyCertPath)
+	require.NoError(t, err)
+
+	for _, node := range nodes {
+		assert.Empty(t, node.Keys())
+	}
+
+	// Keys in different hash slots of the failover client are not deleted in transactions
+	rs, ctx = provisionFailoverRedisStorage(t)
+
+	for i := range 20 {
+		key := fmt.Sprintf("%s/domain%02d.com/domain%02d.com.crt", TestKeyAcmePath, i, i)
+		err := rs.Store(ctx, key, TestValueCrt)
+		require.NoError(t, err)
+	}
+
+	err = rs.Delete(ctx, TestKeyCertPath)
+	require.NoError(t, err)
+
+	keys, err := rs.client.Keys(ctx, "*").Result()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
@@ -18,40 +18,181 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/zlib"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
 )
 
-const maxDecompressedBytes int64 = 4 << 20 // 4 MiB
+// Default limit on the size of stored and decompressed values
+const defaultMaxValueSize int64 = 4 << 20 // 4 MiB
+
+// Valid compression_level ranges for each compression algorithm
+const (
+	minFlateCompressionLevel = flate.HuffmanOnly
+	maxFlateCompressionLevel = flate.BestCompression
+	minZstdCompressionLevel  = 1
+	maxZstdCompressionLevel  = 22
+	// Default level of the reference zstd implementation
+	defaultZstdCompressionLevel = 3
+)
 
 // compress compresses input using the algorithm specified by rs.Compression.
 func (rs *RedisStorage) compress(input []byte) ([]byte, error) {
-	if rs.Compression == CompressionZlib {
+	level := rs.compressionLevel()
+	switch rs.Compression {
+	case CompressionZstd:
+		return compressWriter(input, func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, rs.zstdEncoderOptions(level)...)
+		})
+	case CompressionZlib:
 		return compressWriter(input, func(w io.Writer) (io.WriteCloser, error) {
-			return zlib.NewWriter(w), nil
+			return zlib.NewWriterLevel(w, level)
 		})
 	}
 	return compressWriter(input, func(w io.Writer) (io.WriteCloser, error) {
-		return flate.NewWriter(w, flate.DefaultCompression)
+		return flate.NewWriter(w, level)
 	})
 }
 
 // decompress decompresses input using the algorithm identified by compressionFlag,
 // which is the value stored in StorageData.Compression for the given key.
-// This allows flate- and zlib-compressed values to coexist in Redis without migration.
+// This allows flate-, zlib- and zstd-compressed values to coexist in Redis without migration.
 func (rs *RedisStorage) decompress(input []byte, compressionFlag int) ([]byte, error) {
-	if compressionFlag == storageCompressionZlib {
+	switch compressionFlag {
+	case storageCompressionZstd:
+		decoder, err := zstd.NewReader(bytes.NewReader(input), rs.zstdDecoderOptions()...)
+		if err == nil {
+			var output []byte
+			output, err = decompressReader(decoder.IOReadCloser(), rs.maxValueSize())
+			if err == nil {
+				return output, nil
+			}
+		}
+		// Frames declaring a window or content size above the limit are rejected before decoding
+		if errors.Is(err, zstd.ErrWindowSizeExceeded) || errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+			return nil, fmt.Errorf("decompressed value exceeds limit (%d bytes)", rs.maxValueSize())
+		}
+		return nil, err
+	case storageCompressionZlib:
 		reader, err := zlib.NewReader(bytes.NewReader(input))
 		if err != nil {
 			return nil, err
 		}
-		return decompressReader(reader)
+		return decompressReader(reader, rs.maxValueSize())
+	}
+	return decompressReader(flate.NewReader(bytes.NewReader(input)), rs.maxValueSize())
+}
+
+// compressionFlag returns the StorageData.Compression value for rs.Compression.
+func (rs *RedisStorage) compressionFlag() int {
+	switch rs.Compression {
+	case CompressionZstd:
+		return storageCompressionZstd
+	case CompressionZlib:
+		return storageCompressionZlib
+	case CompressionFlate:
+		return storageCompressionFlate
+	}
+	return storageCompressionNone
+}
+
+// maxValueSize returns the configured maximum value size or the default limit.
+func (rs *RedisStorage) maxValueSize() int64 {
+	if rs.MaxValueSize == "" {
+		return defaultMaxValueSize
+	}
+	// Was already sanity-checked in finalizeConfiguration
+	size, _ := strconv.ParseInt(rs.MaxValueSize, 10, 64)
+	return size
+}
+
+// compressionMinSize returns the configured minimum size of values to compress.
+func (rs *RedisStorage) compressionMinSize() int {
+	if rs.CompressionMinSize == "" {
+		return 0
+	}
+	// Was already sanity-checked in finalizeConfiguration
+	size, _ := strconv.Atoi(rs.CompressionMinSize)
+	return size
+}
+
+// compressionLevel returns the configured compression level or the default level
+// of the configured compression algorithm if none was specified.
+func (rs *RedisStorage) compressionLevel() int {
+	if rs.CompressionLevel == "" {
+		if rs.Compression == CompressionZstd {
+			return defaultZstdCompressionLevel
+		}
+		return flate.DefaultCompression
+	}
+	// Was already sanity-checked in finalizeConfiguration
+	level, _ := strconv.Atoi(rs.CompressionLevel)
+	return level
+}
+
+// validateCompressionLevel checks that rs.CompressionLevel is valid for rs.Compression.
+func (rs *RedisStorage) validateCompressionLevel() error {
+	if rs.CompressionLevel == "" {
+		return nil
+	}
+	level, err := strconv.Atoi(rs.CompressionLevel)
+	if err != nil {
+		return fmt.Errorf("invalid compression_level value: %s", rs.CompressionLevel)
+	}
+	minLevel, maxLevel := minFlateCompressionLevel, maxFlateCompressionLevel
+	if rs.Compression == CompressionZstd {
+		minLevel, maxLevel = minZstdCompressionLevel, maxZstdCompressionLevel
+	}
+	if level < minLevel || level > maxLevel {
+		return fmt.Errorf("invalid compression_level value for '%s': %d (expected %d to %d)", rs.Compression, level, minLevel, maxLevel)
+	}
+	return nil
+}
+
+// zstdEncoderOptions returns the zstd encoder options for the given compression level,
+// including the trained dictionary if one was configured.
+func (rs *RedisStorage) zstdEncoderOptions(level int) []zstd.EOption {
+	opts := []zstd.EOption{
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+		zstd.WithEncoderConcurrency(1),
+	}
+	if len(rs.compressionDictionary) > 0 {
+		opts = append(opts, zstd.WithEncoderDict(rs.compressionDictionary))
+	}
+	return opts
+}
+
+// zstdDecoderOptions returns the zstd decoder options, including the trained dictionary if one
+// was configured. Values compressed without a dictionary remain readable when one is added.
+// The memory and window size of the decoder are limited to the maximum value size, so that
+// frames declaring a large window cannot allocate memory beyond the limit.
+func (rs *RedisStorage) zstdDecoderOptions() []zstd.DOption {
+	maxSize := uint64(rs.maxValueSize())
+	opts := []zstd.DOption{
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderMaxMemory(maxSize),
+		zstd.WithDecoderMaxWindow(max(maxSize, zstd.MinWindowSize)),
+	}
+	if len(rs.compressionDictionary) > 0 {
+		opts = append(opts, zstd.WithDecoderDicts(rs.compressionDictionary))
+	}
+	return opts
+}
+
+// validateCompressionDictionary checks that a zstd encoder can be created with the loaded dictionary.
+func (rs *RedisStorage) validateCompressionDictionary() error {
+	encoder, err := zstd.NewWriter(io.Discard, rs.zstdEncoderOptions(rs.compressionLevel())...)
+	if err != nil {
+		return fmt.Errorf("invalid compression_dictionary: %v", err)
 	}
-	return decompressReader(flate.NewReader(bytes.NewReader(input)))
+	return encoder.Close()
 }
 
 // compressWriter compresses input by writing it through a writer constructed by newWriter.
-// This shared helper eliminates duplication between the flate and zlib compress paths.
+// This shared helper eliminates duplication between the compress paths of each algorithm.
 func compressWriter(input []byte, newWriter func(io.Writer) (io.WriteCloser, error)) ([]byte, error) {
 	var buf bytes.Buffer
 	writer, err := newWriter(&buf)
@@ -67,18 +208,18 @@ func compressWriter(input []byte, newWriter func(io.Writer) (io.WriteCloser, err
 	return buf.Bytes(), nil
 }
 
-// decompressReader reads all decompressed bytes from reader, enforcing the 4 MiB limit
-// to guard against decompression bombs. Used by both flate and zlib decompress paths.
-func decompressReader(reader io.ReadCloser) ([]byte, error) {
+// decompressReader reads all decompressed bytes from reader, enforcing the limit
+// to guard against decompression bombs. Used by the decompress paths of each algorithm.
+func decompressReader(reader io.ReadCloser, limit int64) ([]byte, error) {
 	defer reader.Close()
 	// Read one byte beyond the limit so we can detect if the limit was exceeded.
-	limitedReader := io.LimitReader(reader, maxDecompressedBytes+1)
+	limitedReader := io.LimitReader(reader, limit+1)
 	output, err := io.ReadAll(limitedReader)
 	if err != nil {
 		return nil, err
 	}
-	if int64(len(output)) > maxDecompressedBytes {
-		return nil, fmt.Errorf("decompressed value exceeds limit (%d bytes)", maxDecompressedBytes)
+	if int64(len(output)) > limit {
+		return nil, fmt.Errorf("decompressed value exceeds limit (%d bytes)", limit)
 	}
 	return output, nil
 }
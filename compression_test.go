@@ -15,9 +15,14 @@
 package storageredis
 
 import (
+	"bytes"
+	"fmt"
+	"strconv"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRedisStorage_FlateCompressDecompress(t *testing.T) {
@@ -46,10 +51,140 @@ func TestRedisStorage_ZlibCompressDecompress(t *testing.T) {
 	assert.Equal(t, originalValue, decompressedValue)
 }
 
+func TestRedisStorage_ZstdCompressDecompress(t *testing.T) {
+	rs := New()
+	rs.Compression = CompressionZstd
+	originalValue := []byte("Q2FkZHkgUmVkaXMgU3RvcmFnZQ==")
+
+	compressedValue, err := rs.compress(originalValue)
+	assert.NoError(t, err)
+
+	decompressedValue, err := rs.decompress(compressedValue, storageCompressionZstd)
+	assert.NoError(t, err)
+	assert.Equal(t, originalValue, decompressedValue)
+}
+
+func TestRedisStorage_CompressionLevel(t *testing.T) {
+	originalValue := bytes.Repeat([]byte("Q2FkZHkgUmVkaXMgU3RvcmFnZQ=="), 64)
+
+	tests := []struct {
+		compression CompressionMode
+		flag        int
+		level       string
+	}{
+		{compression: CompressionFlate, flag: storageCompressionFlate, level: "1"},
+		{compression: CompressionFlate, flag: storageCompressionFlate, level: "9"},
+		{compression: CompressionZlib, flag: storageCompressionZlib, level: "0"},
+		{compression: CompressionZlib, flag: storageCompressionZlib, level: "-2"},
+		{compression: CompressionZstd, flag: storageCompressionZstd, level: "1"},
+		{compression: CompressionZstd, flag: storageCompressionZstd, level: "19"},
+	}
+
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%s level %s", tc.compression, tc.level), func(t *testing.T) {
+			rs := New()
+			rs.Compression = tc.compression
+			rs.CompressionLevel = tc.level
+			require.NoError(t, rs.validateCompressionLevel())
+
+			compressedValue, err := rs.compress(originalValue)
+			assert.NoError(t, err)
+
+			decompressedValue, err := rs.decompress(compressedValue, tc.flag)
+			assert.NoError(t, err)
+			assert.Equal(t, originalValue, decompressedValue)
+		})
+	}
+}
+
+func TestRedisStorage_ValidateCompressionLevel(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		compression CompressionMode
+		level       string
+		wantErr     bool
+	}{
+		{name: "empty level uses default", compression: CompressionFlate, level: ""},
+		{name: "flate best compression", compression: CompressionFlate, level: "9"},
+		{name: "flate above range", compression: CompressionFlate, level: "10", wantErr: true},
+		{name: "zlib below range", compression: CompressionZlib, level: "-3", wantErr: true},
+		{name: "zstd max level", compression: CompressionZstd, level: "22"},
+		{name: "zstd zero rejected", compression: CompressionZstd, level: "0", wantErr: true},
+		{name: "non numeric rejected", compression: CompressionZstd, level: "fast", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			rs := New()
+			rs.Compression = tc.compression
+			rs.CompressionLevel = tc.level
+			err := rs.validateCompressionLevel()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRedisStorage_ZstdDictionaryCompressDecompress(t *testing.T) {
+	var samples [][]byte
+	for i := range 64 {
+		samples = append(samples, []byte(fmt.Sprintf(`{"sans":["example%d.com"],"issuer_data":{"url":"https://acme-v02.api.letsencrypt.org/acme/cert/%d"}}`, i, i)))
+	}
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       1,
+		Contents: samples,
+		History:  bytes.Join(samples, nil),
+		Offsets:  [3]int{1, 4, 8},
+	})
+	require.NoError(t, err)
+
+	plain := New()
+	plain.Compression = CompressionZstd
+	originalValue := []byte(`{"sans":["example.net"],"issuer_data":{"url":"https://acme-v02.api.letsencrypt.org/acme/cert/1234"}}`)
+
+	// Value compressed before the dictionary was configured
+	plainValue, err := plain.compress(originalValue)
+	require.NoError(t, err)
+
+	rs := New()
+	rs.Compression = CompressionZstd
+	rs.compressionDictionary = dict
+	require.NoError(t, rs.validateCompressionDictionary())
+
+	compressedValue, err := rs.compress(originalValue)
+	assert.NoError(t, err)
+	assert.Less(t, len(compressedValue), len(plainValue))
+
+	decompressedValue, err := rs.decompress(compressedValue, storageCompressionZstd)
+	assert.NoError(t, err)
+	assert.Equal(t, originalValue, decompressedValue)
+
+	decompressedValue, err = rs.decompress(plainValue, storageCompressionZstd)
+	assert.NoError(t, err)
+	assert.Equal(t, originalValue, decompressedValue)
+}
+
+func TestRedisStorage_InvalidZstdDictionaryRejected(t *testing.T) {
+	rs := New()
+	rs.Compression = CompressionZstd
+	rs.compressionDictionary = []byte("not a zstd dictionary")
+
+	err := rs.validateCompressionDictionary()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid compression_dictionary")
+}
+
 func TestRedisStorage_FlateDecompressExceedsLimit(t *testing.T) {
 	rs := New()
 	rs.Compression = CompressionFlate
-	originalValue := make([]byte, maxDecompressedBytes+1)
+	originalValue := make([]byte, defaultMaxValueSize+1)
 
 	compressedValue, err := rs.compress(originalValue)
 	assert.NoError(t, err)
@@ -63,7 +198,7 @@ func TestRedisStorage_FlateDecompressExceedsLimit(t *testing.T) {
 func TestRedisStorage_ZlibDecompressExceedsLimit(t *testing.T) {
 	rs := New()
 	rs.Compression = CompressionZlib
-	originalValue := make([]byte, maxDecompressedBytes+1)
+	originalValue := make([]byte, defaultMaxValueSize+1)
 
 	compressedValue, err := rs.compress(originalValue)
 	assert.NoError(t, err)
@@ -73,3 +208,76 @@ func TestRedisStorage_ZlibDecompressExceedsLimit(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "decompressed value exceeds limit")
 }
+
+func TestRedisStorage_ZstdDecompressExceedsLimit(t *testing.T) {
+	rs := New()
+	rs.Compression = CompressionZstd
+	originalValue := make([]byte, defaultMaxValueSize+1)
+
+	compressedValue, err := rs.compress(originalValue)
+	assert.NoError(t, err)
+
+	decompressedValue, err := rs.decompress(compressedValue, storageCompressionZstd)
+	assert.Nil(t, decompressedValue)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "decompressed value exceeds limit")
+}
+
+func TestRedisStorage_ZstdDecompressWindowExceedsLimit(t *testing.T) {
+	rs := New()
+	rs.Compression = CompressionZstd
+
+	// Frame declaring a 512 MiB window without content size, followed by a single RLE block
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 19 << 3}
+	frame = append(frame, 0x0b, 0x00, 0x00, 'a')
+
+	decompressedValue, err := rs.decompress(frame, storageCompressionZstd)
+	assert.Nil(t, decompressedValue)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "decompressed value exceeds limit")
+
+	// Values compressed below a small limit remain readable
+	rs.MaxValueSize = "16384"
+	originalValue := bytes.Repeat([]byte("caddy-storage-redis"), 512)
+
+	compressedValue, err := rs.compress(originalValue)
+	assert.NoError(t, err)
+
+	decompressedValue, err = rs.decompress(compressedValue, storageCompressionZstd)
+	assert.NoError(t, err)
+	assert.Equal(t, originalValue, decompressedValue)
+}
+
+func TestRedisStorage_DecompressConfiguredLimit(t *testing.T) {
+	rs := New()
+	rs.Compression = CompressionZlib
+	originalValue := make([]byte, 1024)
+
+	compressedValue, err := rs.compress(originalValue)
+	assert.NoError(t, err)
+
+	rs.MaxValueSize = "1023"
+	decompressedValue, err := rs.decompress(compressedValue, storageCompressionZlib)
+	assert.Nil(t, decompressedValue)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "decompressed value exceeds limit (1023 bytes)")
+
+	rs.MaxValueSize = "1024"
+	decompressedValue, err = rs.decompress(compressedValue, storageCompressionZlib)
+	assert.NoError(t, err)
+	assert.Equal(t, originalValue, decompressedValue)
+}
+
+func TestRedisStorage_DecompressAboveDefaultLimit(t *testing.T) {
+	rs := New()
+	rs.Compression = CompressionFlate
+	rs.MaxValueSize = strconv.FormatInt(2*defaultMaxValueSize, 10)
+	originalValue := make([]byte, defaultMaxValueSize+1)
+
+	compressedValue, err := rs.compress(originalValue)
+	assert.NoError(t, err)
+
+	decompressedValue, err := rs.decompress(compressedValue, storageCompressionFlate)
+	assert.NoError(t, err)
+	assert.Equal(t, originalValue, decompressedValue)
+}
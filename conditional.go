@@ -0,0 +1,93 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrStoreConflict is returned by conditional store operations when the currently stored
+// value does not satisfy the condition, e.g. because it was modified by another Caddy instance.
+var ErrStoreConflict = errors.New("stored value was modified concurrently")
+
+// StoreIfUnmodifiedSince stores value at key only if key does not exist or has not been
+// modified after since. Returns an error wrapping ErrStoreConflict if the condition fails.
+func (rs *RedisStorage) StoreIfUnmodifiedSince(ctx context.Context, key string, value []byte, since time.Time) error {
+	return rs.storeConditional(ctx, key, value, func(current *StorageData) bool {
+		return current == nil || !current.Modified.After(since)
+	})
+}
+
+// StoreIfVersion stores value at key only if the modified time of the currently stored value
+// (as returned by Stat) equals version. A zero version requires that key does not exist yet.
+// Returns an error wrapping ErrStoreConflict if the condition fails.
+func (rs *RedisStorage) StoreIfVersion(ctx context.Context, key string, value []byte, version time.Time) error {
+	return rs.storeConditional(ctx, key, value, func(current *StorageData) bool {
+		if current == nil {
+			return version.IsZero()
+		}
+		return current.Modified.Equal(version)
+	})
+}
+
+// storeConditional stores value at key if condition returns true for the currently stored
+// StorageData (nil if key does not exist). The check and write are performed within a
+// transaction watching key, so a concurrent modification also results in a conflict.
+func (rs *RedisStorage) storeConditional(ctx context.Context, key string, value []byte, condition func(*StorageData) bool) error {
+
+	sd, err := rs.encodeStorageData(key, value)
+	if err != nil {
+		return err
+	}
+
+	var prefixedKey = rs.prefixKey(key)
+	var ttl = rs.keyTTL(key)
+
+	err = rs.client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := rs.readStorageData(ctx, tx, prefixedKey)
+		if errors.Is(err, fs.ErrNotExist) {
+			current = nil
+		} else if err != nil {
+			return err
+		}
+		if !condition(current) {
+			return ErrStoreConflict
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return rs.queueStorageData(ctx, pipe, prefixedKey, sd, ttl)
+		})
+		return err
+	}, prefixedKey)
+
+	if errors.Is(err, ErrStoreConflict) || errors.Is(err, redis.TxFailedErr) {
+		return fmt.Errorf("Unable to set value for %s: %w", key, ErrStoreConflict)
+	} else if err != nil {
+		return fmt.Errorf("Unable to set value for %s: %v", key, err)
+	}
+
+	// Create directory structure set for current key once the value was stored
+	score := float64(sd.Modified.Unix())
+	if err := rs.storeDirectoryRecord(ctx, prefixedKey, score, false); err != nil {
+		return fmt.Errorf("Unable to create directory for key %s: %v", key, err)
+	}
+
+	return rs.updateExpiryIndex(ctx, key, prefixedKey, ttl)
+}
@@ -0,0 +1,126 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisStorage_StoreIfVersion(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	// Zero version requires the key to not exist
+	err := rs.StoreIfVersion(ctx, TestKeyExampleJson, TestValueJson, time.Time{})
+	require.NoError(t, err)
+
+	err = rs.StoreIfVersion(ctx, TestKeyExampleJson, TestValueKey, time.Time{})
+	assert.True(t, errors.Is(err, ErrStoreConflict))
+
+	// Directory index is created for conditionally stored keys
+	keys, err := rs.List(ctx, TestKeyExamplePath, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{TestKeyExampleJson}, keys)
+
+	stat, err := rs.Stat(ctx, TestKeyExampleJson)
+	require.NoError(t, err)
+
+	// Matching version succeeds and produces a new version
+	err = rs.StoreIfVersion(ctx, TestKeyExampleJson, TestValueCrt, stat.Modified)
+	require.NoError(t, err)
+
+	loadedValue, err := rs.Load(ctx, TestKeyExampleJson)
+	assert.NoError(t, err)
+	assert.Equal(t, TestValueCrt, loadedValue)
+
+	// Stale version is rejected and the stored value is left unchanged
+	err = rs.StoreIfVersion(ctx, TestKeyExampleJson, TestValueKey, stat.Modified)
+	assert.True(t, errors.Is(err, ErrStoreConflict))
+
+	loadedValue, err = rs.Load(ctx, TestKeyExampleJson)
+	assert.NoError(t, err)
+	assert.Equal(t, TestValueCrt, loadedValue)
+
+	// Non-zero version requires the key to exist
+	err = rs.StoreIfVersion(ctx, TestKeyExampleKey, TestValueKey, stat.Modified)
+	assert.True(t, errors.Is(err, ErrStoreConflict))
+	assert.False(t, rs.Exists(ctx, TestKeyExampleKey))
+}
+
+func TestRedisStorage_StoreIfUnmodifiedSince(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	// Missing keys are always stored
+	beforeStore := time.Now()
+	err := rs.StoreIfUnmodifiedSince(ctx, TestKeyExampleJson, TestValueJson, beforeStore)
+	require.NoError(t, err)
+
+	// Key was modified after beforeStore
+	err = rs.StoreIfUnmodifiedSince(ctx, TestKeyExampleJson, TestValueKey, beforeStore)
+	assert.True(t, errors.Is(err, ErrStoreConflict))
+
+	// Key was not modified after the current time
+	err = rs.StoreIfUnmodifiedSince(ctx, TestKeyExampleJson, TestValueCrt, time.Now())
+	assert.NoError(t, err)
+
+	loadedValue, err := rs.Load(ctx, TestKeyExampleJson)
+	assert.NoError(t, err)
+	assert.Equal(t, TestValueCrt, loadedValue)
+}
+
+func TestRedisStorage_StoreIfVersionConcurrent(t *testing.T) {
+
+	for _, layout := range []StorageLayout{StorageLayoutString, StorageLayoutHash} {
+		t.Run(string(layout), func(t *testing.T) {
+
+			rs, ctx := provisionRedisStorage(t)
+			rs.StorageLayout = layout
+
+			err := rs.Store(ctx, TestKeyExampleJson, TestValueJson)
+			require.NoError(t, err)
+			stat, err := rs.Stat(ctx, TestKeyExampleJson)
+			require.NoError(t, err)
+
+			const goroutines = 5
+			var wg sync.WaitGroup
+			var succeeded int32
+
+			// Only one writer may succeed when all race to update the same version
+			wg.Add(goroutines)
+			for range goroutines {
+				go func() {
+					defer wg.Done()
+					err := rs.StoreIfVersion(ctx, TestKeyExampleJson, TestValueCrt, stat.Modified)
+					if err == nil {
+						atomic.AddInt32(&succeeded, 1)
+					} else {
+						assert.True(t, errors.Is(err, ErrStoreConflict))
+					}
+				}()
+			}
+			wg.Wait()
+
+			assert.Equal(t, int32(1), succeeded)
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+)
+
+// CopyOptions control how keys are replicated by CopyTo.
+type CopyOptions struct {
+	// Incremental skips keys modified in the destination at or after the source
+	Incremental bool
+	// Delete removes keys from the destination that do not exist in the source
+	Delete bool
+}
+
+// CopyResult summarises the keys processed by CopyTo.
+type CopyResult struct {
+	Copied  int `json:"copied"`
+	Skipped int `json:"skipped"`
+	Deleted int `json:"deleted"`
+}
+
+// CopyTo replicates every key stored in rs to dst, preserving modification times. Values are
+// decoded using the configuration of rs and stored using the compression and encryption of dst,
+// so both storages may use different settings.
+func (rs *RedisStorage) CopyTo(ctx context.Context, dst *RedisStorage, opts CopyOptions) (*CopyResult, error) {
+
+	var result = &CopyResult{}
+	var sourceKeys = map[string]struct{}{}
+
+	for key, err := range rs.ListIter(ctx, "", true) {
+		if err != nil {
+			return result, err
+		}
+
+		sd, err := rs.loadStorageData(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Deleted since listed, or stale directory record
+			continue
+		} else if err != nil {
+			return result, err
+		}
+		if opts.Delete {
+			sourceKeys[key] = struct{}{}
+		}
+
+		// Skip keys that are up to date in the destination
+		if opts.Incremental {
+			modified, _, err := dst.statStorageData(ctx, dst.prefixKey(key))
+			if err == nil && !modified.Before(sd.Modified) {
+				result.Skipped++
+				continue
+			} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return result, err
+			}
+		}
+
+		value, err := rs.decodeStorageData(key, sd)
+		if err != nil {
+			return result, err
+		}
+		dstData, err := dst.encodeStorageData(key, value)
+		if err != nil {
+			return result, err
+		}
+		dstData.Modified = sd.Modified
+		if err := dst.storeStorageData(ctx, key, dstData); err != nil {
+			return result, err
+		}
+		result.Copied++
+	}
+
+	if !opts.Delete {
+		return result, nil
+	}
+
+	// Collect extra keys before deleting them, as deleting modifies the directory index
+	var extraKeys []string
+	for key, err := range dst.ListIter(ctx, "", true) {
+		if err != nil {
+			return result, err
+		}
+		if _, ok := sourceKeys[key]; !ok {
+			extraKeys = append(extraKeys, key)
+		}
+	}
+	for _, key := range extraKeys {
+		if err := dst.Delete(ctx, key); err != nil {
+			return result, err
+		}
+		result.Deleted++
+	}
+
+	return result, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisStorage_CopyTo(t *testing.T) {
+
+	source, ctx := provisionRedisStorage(t)
+	target, _ := provisionRedisStorage(t)
+	target.KeyPrefix = "production"
+	target.EncryptionKey = "oZO3BDDMuwC23croDwRr1aedfs5kcM8l"
+	target.Compression = CompressionZlib
+	target.StorageLayout = StorageLayoutHash
+
+	values := map[string][]byte{
+		TestKeyExampleCrt:  TestValueCrt,
+		TestKeyExampleKey:  TestValueKey,
+		"ocsp/example.com": TestValueJson,
+	}
+	for key, value := range values {
+		err := source.Store(ctx, key, value)
+		require.NoError(t, err)
+	}
+	err := target.Store(ctx, "ocsp/extra.com", TestValueJson)
+	require.NoError(t, err)
+
+	result, err := source.CopyTo(ctx, target, CopyOptions{Incremental: true})
+	require.NoError(t, err)
+	assert.Equal(t, CopyResult{Copied: 3}, *result)
+
+	for key, value := range values {
+		loaded, err := target.Load(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, value, loaded)
+
+		sourceInfo, err := source.Stat(ctx, key)
+		require.NoError(t, err)
+		targetInfo, err := target.Stat(ctx, key)
+		require.NoError(t, err)
+		assert.True(t, sourceInfo.Modified.Equal(targetInfo.Modified))
+	}
+
+	// Only keys modified in the source since the previous copy are copied again
+	err = source.Store(ctx, TestKeyExampleCrt, TestValueKey)
+	require.NoError(t, err)
+
+	result, err = source.CopyTo(ctx, target, CopyOptions{Incremental: true, Delete: true})
+	require.NoError(t, err)
+	assert.Equal(t, CopyResult{Copied: 1, Skipped: 2, Deleted: 1}, *result)
+
+	loaded, err := target.Load(ctx, TestKeyExampleCrt)
+	require.NoError(t, err)
+	assert.Equal(t, TestValueKey, loaded)
+
+	keys, err := target.List(ctx, "", true)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{TestKeyExampleCrt, TestKeyExampleKey, "ocsp/example.com"}, keys)
+
+	// Without incremental mode every key is copied
+	result, err = source.CopyTo(ctx, target, CopyOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, CopyResult{Copied: 3}, *result)
+}
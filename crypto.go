@@ -17,52 +17,192 @@ package storageredis
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
+// encrypt encrypts input using the algorithm specified by rs.EncryptionAlgorithm.
+// The random nonce is prepended to the returned ciphertext.
 func (rs *RedisStorage) encrypt(bytes []byte) ([]byte, error) {
 
-	c, err := aes.NewCipher([]byte(rs.EncryptionKey))
+	aead, err := rs.newAEAD(rs.encryptionFlag())
 	if err != nil {
-		return nil, fmt.Errorf("Unable to create AES cipher: %v", err)
+		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(c)
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to create GCM cipher: %v", err)
+		return nil, fmt.Errorf("Unable to generate nonce: %v", err)
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	_, err = io.ReadFull(rand.Reader, nonce)
+	return aead.Seal(nonce, nonce, bytes, nil), nil
+}
+
+// decrypt decrypts input using the algorithm identified by encryptionFlag,
+// which is the value stored in StorageData.Encryption for the given key.
+// This allows values encrypted with different algorithms to coexist in Redis.
+func (rs *RedisStorage) decrypt(bytes []byte, encryptionFlag int) ([]byte, error) {
+
+	aead, err := rs.newAEAD(encryptionFlag)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to generate nonce: %v", err)
+		return nil, err
+	}
+
+	if len(bytes) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("Invalid encrypted data")
 	}
 
-	return gcm.Seal(nonce, nonce, bytes, nil), nil
+	out, err := aead.Open(nil, bytes[:aead.NonceSize()], bytes[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Decryption failure: %v", err)
+	}
+
+	return out, nil
+}
+
+// encryptionFlag returns the StorageData.Encryption value for rs.EncryptionAlgorithm.
+func (rs *RedisStorage) encryptionFlag() int {
+	if rs.EncryptionAlgorithm == EncryptionXChaCha20Poly1305 {
+		return storageEncryptionXChaCha20Poly1305
+	}
+	return storageEncryptionAESGCM
 }
 
-func (rs *RedisStorage) decrypt(bytes []byte) ([]byte, error) {
+// newAEAD creates the AEAD cipher identified by encryptionFlag using rs.EncryptionKey.
+func (rs *RedisStorage) newAEAD(encryptionFlag int) (cipher.AEAD, error) {
+
+	switch encryptionFlag {
+	case storageEncryptionAESGCM:
+		block, err := aes.NewCipher([]byte(rs.EncryptionKey))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create AES cipher: %v", err)
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create GCM cipher: %v", err)
+		}
+		return gcm, nil
+	case storageEncryptionXChaCha20Poly1305:
+		aead, err := chacha20poly1305.NewX([]byte(rs.EncryptionKey))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create XChaCha20-Poly1305 cipher: %v", err)
+		}
+		return aead, nil
+	default:
+		return nil, fmt.Errorf("Unsupported encryption algorithm: %d", encryptionFlag)
+	}
+}
+
+// Context strings used to derive independent key name encryption keys from rs.EncryptionKey
+const (
+	keyNameCipherContext = "caddy-storage-redis key name cipher"
+	keyNameNonceContext  = "caddy-storage-redis key name nonce"
+)
+
+// initKeyNameCipher derives the keys used to deterministically encrypt Redis key path segments.
+// A dedicated AES-GCM key is always used regardless of rs.EncryptionAlgorithm so that
+// encrypted key names remain stable if the value encryption algorithm is changed.
+func (rs *RedisStorage) initKeyNameCipher() error {
 
-	block, err := aes.NewCipher([]byte(rs.EncryptionKey))
+	block, err := aes.NewCipher(deriveKey(rs.EncryptionKey, keyNameCipherContext))
 	if err != nil {
-		return nil, fmt.Errorf("Unable to create AES cipher: %v", err)
+		return fmt.Errorf("Unable to create AES cipher: %v", err)
 	}
 
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to create GCM cipher: %v", err)
+		return fmt.Errorf("Unable to create GCM cipher: %v", err)
 	}
 
-	if len(bytes) < gcm.NonceSize()+gcm.Overhead() {
-		return nil, fmt.Errorf("Invalid encrypted data")
+	rs.keyNameCipher = gcm
+	rs.keyNameNonceKey = deriveKey(rs.EncryptionKey, keyNameNonceContext)
+	return nil
+}
+
+// encodeKeyPath encrypts every segment of a storage key path when key name encryption is enabled.
+func (rs *RedisStorage) encodeKeyPath(key string) string {
+	if rs.keyNameCipher == nil || key == "" {
+		return key
+	}
+	segments := strings.Split(key, keyPathSeparator)
+	for idx, segment := range segments {
+		if segment != "" {
+			segments[idx] = rs.encryptKeySegment(segment)
+		}
 	}
+	return strings.Join(segments, keyPathSeparator)
+}
 
-	out, err := gcm.Open(nil, bytes[:gcm.NonceSize()], bytes[gcm.NonceSize():], nil)
+// decodeKeyPath reverses encodeKeyPath, returning an error if any segment cannot be decrypted.
+func (rs *RedisStorage) decodeKeyPath(key string) (string, error) {
+	if rs.keyNameCipher == nil || key == "" {
+		return key, nil
+	}
+	segments := strings.Split(key, keyPathSeparator)
+	for idx, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		decoded, err := rs.decryptKeySegment(segment)
+		if err != nil {
+			return "", fmt.Errorf("Unable to decrypt key name segment '%s': %v", segment, err)
+		}
+		segments[idx] = decoded
+	}
+	return strings.Join(segments, keyPathSeparator), nil
+}
+
+// encryptKeySegment deterministically encrypts a single key path segment using a synthetic
+// nonce derived from an HMAC of the plaintext, so equal segments always map to the same name.
+func (rs *RedisStorage) encryptKeySegment(segment string) string {
+	nonce := rs.keyNameNonce(segment)
+	sealed := rs.keyNameCipher.Seal(nonce, nonce, []byte(segment), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// decryptKeySegment decrypts a single key path segment and verifies its synthetic nonce.
+func (rs *RedisStorage) decryptKeySegment(segment string) (string, error) {
+
+	sealed, err := base64.RawURLEncoding.DecodeString(segment)
 	if err != nil {
-		return nil, fmt.Errorf("Decryption failure: %v", err)
+		return "", err
 	}
 
-	return out, nil
+	nonceSize := rs.keyNameCipher.NonceSize()
+	if len(sealed) < nonceSize+rs.keyNameCipher.Overhead() {
+		return "", fmt.Errorf("Invalid encrypted data")
+	}
+
+	out, err := rs.keyNameCipher.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", fmt.Errorf("Decryption failure: %v", err)
+	}
+
+	if !hmac.Equal(sealed[:nonceSize], rs.keyNameNonce(string(out))) {
+		return "", fmt.Errorf("Decryption failure: nonce mismatch")
+	}
+
+	return string(out), nil
+}
+
+// keyNameNonce returns the synthetic nonce for a key path segment.
+func (rs *RedisStorage) keyNameNonce(segment string) []byte {
+	mac := hmac.New(sha256.New, rs.keyNameNonceKey)
+	mac.Write([]byte(segment))
+	return mac.Sum(nil)[:rs.keyNameCipher.NonceSize()]
+}
+
+// deriveKey derives a 32 byte subkey of secret for the given context.
+func deriveKey(secret, context string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(context))
+	return mac.Sum(nil)
 }
@@ -15,9 +15,11 @@
 package storageredis
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRedisStorage_EncryptDecrypt(t *testing.T) {
@@ -29,23 +31,77 @@ func TestRedisStorage_EncryptDecrypt(t *testing.T) {
 	encryptedValue, err := rs.encrypt(originalValue)
 	assert.NoError(t, err)
 
-	decryptedValue, err := rs.decrypt(encryptedValue)
+	decryptedValue, err := rs.decrypt(encryptedValue, storageEncryptionAESGCM)
 	assert.NoError(t, err)
 	assert.Equal(t, originalValue, decryptedValue)
 }
 
+func TestRedisStorage_XChaCha20EncryptDecrypt(t *testing.T) {
+
+	rs := New()
+	rs.EncryptionKey = "1aedfs5kcM8lOZO3BDDMuwC23croDwRr"
+	rs.EncryptionAlgorithm = EncryptionXChaCha20Poly1305
+	originalValue := []byte("Q2FkZHkgUmVkaXMgU3RvcmFnZQ==")
+
+	encryptedValue, err := rs.encrypt(originalValue)
+	assert.NoError(t, err)
+	// 24 byte nonce + plaintext + 16 byte tag
+	assert.Len(t, encryptedValue, 24+len(originalValue)+16)
+
+	decryptedValue, err := rs.decrypt(encryptedValue, storageEncryptionXChaCha20Poly1305)
+	assert.NoError(t, err)
+	assert.Equal(t, originalValue, decryptedValue)
+}
+
+func TestRedisStorage_DecryptMixedAlgorithms(t *testing.T) {
+	rs := New()
+	rs.EncryptionKey = "1aedfs5kcM8lOZO3BDDMuwC23croDwRr"
+	plaintext := []byte("Q2FkZHkgUmVkaXMgU3RvcmFnZQ==")
+
+	aesValue, err := rs.encrypt(plaintext)
+	assert.NoError(t, err)
+
+	// Switching algorithm must not affect values already written with the previous one
+	rs.EncryptionAlgorithm = EncryptionXChaCha20Poly1305
+	chachaValue, err := rs.encrypt(plaintext)
+	assert.NoError(t, err)
+
+	decryptedValue, err := rs.decrypt(aesValue, storageEncryptionAESGCM)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decryptedValue)
+
+	decryptedValue, err = rs.decrypt(chachaValue, storageEncryptionXChaCha20Poly1305)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decryptedValue)
+
+	// Decrypting with the wrong algorithm flag fails authentication
+	decryptedValue, err = rs.decrypt(chachaValue, storageEncryptionAESGCM)
+	assert.Nil(t, decryptedValue)
+	assert.Error(t, err)
+}
+
+func TestRedisStorage_DecryptUnsupportedAlgorithmFails(t *testing.T) {
+	rs := New()
+	rs.EncryptionKey = "1aedfs5kcM8lOZO3BDDMuwC23croDwRr"
+
+	decryptedValue, err := rs.decrypt(make([]byte, 64), 99)
+	assert.Nil(t, decryptedValue)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Unsupported encryption algorithm")
+}
+
 func TestRedisStorage_DecryptShortCiphertextFails(t *testing.T) {
 	rs := New()
 	rs.EncryptionKey = "1aedfs5kcM8lOZO3BDDMuwC23croDwRr"
 
 	// 5 bytes: well below the nonce+tag minimum
-	decryptedValue, err := rs.decrypt([]byte("short"))
+	decryptedValue, err := rs.decrypt([]byte("short"), storageEncryptionAESGCM)
 	assert.Nil(t, decryptedValue)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "Invalid encrypted data")
 
 	// 27 bytes: one below the minimum (nonce=12 + tag=16 = 28)
-	decryptedValue, err = rs.decrypt(make([]byte, 27))
+	decryptedValue, err = rs.decrypt(make([]byte, 27), storageEncryptionAESGCM)
 	assert.Nil(t, decryptedValue)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "Invalid encrypted data")
@@ -60,7 +116,7 @@ func TestRedisStorage_DecryptWrongKeyFails(t *testing.T) {
 	assert.NoError(t, err)
 
 	rs.EncryptionKey = "abcdefghijklmnopqrstuvwxyz123456"
-	decryptedValue, err := rs.decrypt(encryptedValue)
+	decryptedValue, err := rs.decrypt(encryptedValue, storageEncryptionAESGCM)
 	assert.Nil(t, decryptedValue)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "Decryption failure")
@@ -75,3 +131,51 @@ func TestRedisStorage_EncryptInvalidKeyFails(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "Unable to create AES cipher")
 }
+
+func TestRedisStorage_EncodeDecodeKeyPath(t *testing.T) {
+	rs := New()
+	rs.EncryptionKey = "1aedfs5kcM8lOZO3BDDMuwC23croDwRr"
+	require.NoError(t, rs.initKeyNameCipher())
+
+	key := "certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.crt"
+
+	encoded := rs.encodeKeyPath(key)
+	assert.NotContains(t, encoded, "example.com")
+	assert.Len(t, strings.Split(encoded, "/"), 4)
+
+	// Encoding is deterministic so that keys can be located again
+	assert.Equal(t, encoded, rs.encodeKeyPath(key))
+	// Common parent directories encode to the same segments
+	assert.True(t, strings.HasPrefix(rs.encodeKeyPath("certificates/other"), strings.Split(encoded, "/")[0]+"/"))
+
+	decoded, err := rs.decodeKeyPath(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, key, decoded)
+}
+
+func TestRedisStorage_DecodeKeyPathFails(t *testing.T) {
+	rs := New()
+	rs.EncryptionKey = "1aedfs5kcM8lOZO3BDDMuwC23croDwRr"
+	require.NoError(t, rs.initKeyNameCipher())
+
+	// Plain segments are rejected
+	_, err := rs.decodeKeyPath("certificates/example.com")
+	assert.Error(t, err)
+
+	// Segments encrypted with a different key are rejected
+	other := New()
+	other.EncryptionKey = "abcdefghijklmnopqrstuvwxyz123456"
+	require.NoError(t, other.initKeyNameCipher())
+	_, err = rs.decodeKeyPath(other.encodeKeyPath("certificates"))
+	assert.Error(t, err)
+}
+
+func TestRedisStorage_KeyPathUnchangedWhenDisabled(t *testing.T) {
+	rs := New()
+	key := "certificates/example.com/example.com.crt"
+
+	assert.Equal(t, key, rs.encodeKeyPath(key))
+	decoded, err := rs.decodeKeyPath(key)
+	assert.NoError(t, err)
+	assert.Equal(t, key, decoded)
+}
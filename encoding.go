@@ -0,0 +1,126 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The binary envelope used to store StorageData in Redis has the following layout:
+//
+//	offset  size  field
+//	0       1     magic byte (never '{' so legacy JSON values can be detected)
+//	1       1     envelope version
+//	2       1     flags (see binaryEnvelopeFlag* constants)
+//	3       1     compression flag (StorageData.Compression)
+//	4       1     encryption flag (StorageData.Encryption)
+//	5       8     modified time in Unix nanoseconds (big endian)
+//	13      8     uncompressed value size in bytes (big endian)
+//	21      32    SHA-256 checksum (StorageData.Checksum), only if binaryEnvelopeFlagChecksum is set
+//	-       -     payload (StorageData.Value)
+const (
+	binaryEnvelopeMagic      byte = 0xCA
+	binaryEnvelopeVersion    byte = 1
+	binaryEnvelopeHeaderSize      = 21
+)
+
+// Binary envelope flag bits
+const (
+	binaryEnvelopeFlagChecksum byte = 1 << iota
+)
+
+// marshalStorageData encodes sd using the value format configured by rs.ValueFormat.
+func (rs *RedisStorage) marshalStorageData(sd *StorageData) ([]byte, error) {
+	if rs.ValueFormat == ValueFormatJSON {
+		return json.Marshal(sd)
+	}
+	return marshalBinaryStorageData(sd)
+}
+
+// unmarshalStorageData decodes data stored in either the binary envelope or the legacy JSON format.
+func unmarshalStorageData(data []byte) (*StorageData, error) {
+	if len(data) > 0 && data[0] == binaryEnvelopeMagic {
+		return unmarshalBinaryStorageData(data)
+	}
+	sd := &StorageData{}
+	if err := json.Unmarshal(data, sd); err != nil {
+		return nil, err
+	}
+	return sd, nil
+}
+
+func marshalBinaryStorageData(sd *StorageData) ([]byte, error) {
+
+	if sd.Compression < 0 || sd.Compression > 0xFF || sd.Encryption < 0 || sd.Encryption > 0xFF {
+		return nil, fmt.Errorf("invalid compression or encryption flag")
+	}
+	if len(sd.Checksum) != 0 && len(sd.Checksum) != sha256.Size {
+		return nil, fmt.Errorf("invalid checksum length %d", len(sd.Checksum))
+	}
+
+	var flags byte
+	if len(sd.Checksum) > 0 {
+		flags |= binaryEnvelopeFlagChecksum
+	}
+
+	data := make([]byte, binaryEnvelopeHeaderSize, binaryEnvelopeHeaderSize+len(sd.Checksum)+len(sd.Value))
+	data[0] = binaryEnvelopeMagic
+	data[1] = binaryEnvelopeVersion
+	data[2] = flags
+	data[3] = byte(sd.Compression)
+	data[4] = byte(sd.Encryption)
+	binary.BigEndian.PutUint64(data[5:13], uint64(sd.Modified.UnixNano()))
+	binary.BigEndian.PutUint64(data[13:21], uint64(sd.Size))
+	data = append(data, sd.Checksum...)
+
+	return append(data, sd.Value...), nil
+}
+
+func unmarshalBinaryStorageData(data []byte) (*StorageData, error) {
+
+	if len(data) < binaryEnvelopeHeaderSize {
+		return nil, fmt.Errorf("truncated binary envelope")
+	}
+	if data[1] != binaryEnvelopeVersion {
+		return nil, fmt.Errorf("unsupported binary envelope version %d", data[1])
+	}
+	flags := data[2]
+	if flags&^binaryEnvelopeFlagChecksum != 0 {
+		return nil, fmt.Errorf("unsupported binary envelope flags %#x", flags)
+	}
+
+	sd := &StorageData{
+		Modified:    time.Unix(0, int64(binary.BigEndian.Uint64(data[5:13]))),
+		Size:        int64(binary.BigEndian.Uint64(data[13:21])),
+		Compression: int(data[3]),
+		Encryption:  int(data[4]),
+	}
+
+	payload := data[binaryEnvelopeHeaderSize:]
+	if flags&binaryEnvelopeFlagChecksum != 0 {
+		if len(payload) < sha256.Size {
+			return nil, fmt.Errorf("truncated binary envelope")
+		}
+		sd.Checksum = payload[:sha256.Size]
+		payload = payload[sha256.Size:]
+	}
+	sd.Value = payload
+
+	return sd, nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshalUnmarshalStorageData(t *testing.T) {
+	t.Parallel()
+
+	sd := &StorageData{
+		Value:       []byte("Q2FkZHkgUmVkaXMgU3RvcmFnZQ=="),
+		Modified:    time.Now(),
+		Size:        1234,
+		Compression: storageCompressionZstd,
+		Encryption:  storageEncryptionXChaCha20Poly1305,
+		Checksum:    bytes.Repeat([]byte{0xAB}, sha256.Size),
+	}
+
+	for _, format := range []ValueFormat{ValueFormatBinary, ValueFormatJSON} {
+		t.Run(string(format), func(t *testing.T) {
+			t.Parallel()
+
+			rs := New()
+			rs.ValueFormat = format
+
+			data, err := rs.marshalStorageData(sd)
+			require.NoError(t, err)
+
+			decoded, err := unmarshalStorageData(data)
+			require.NoError(t, err)
+			assert.Equal(t, sd.Value, decoded.Value)
+			assert.True(t, sd.Modified.Equal(decoded.Modified))
+			assert.Equal(t, sd.Size, decoded.Size)
+			assert.Equal(t, sd.Compression, decoded.Compression)
+			assert.Equal(t, sd.Encryption, decoded.Encryption)
+			assert.Equal(t, sd.Checksum, decoded.Checksum)
+		})
+	}
+}
+
+func TestMarshalBinaryStorageDataSize(t *testing.T) {
+	t.Parallel()
+
+	sd := &StorageData{
+		Value:    make([]byte, 1024),
+		Modified: time.Now(),
+		Size:     1024,
+	}
+
+	data, err := marshalBinaryStorageData(sd)
+	require.NoError(t, err)
+	assert.Len(t, data, binaryEnvelopeHeaderSize+len(sd.Value))
+	assert.Equal(t, binaryEnvelopeMagic, data[0])
+
+	// The legacy JSON encoding base64-encodes the value
+	jsonData, err := json.Marshal(sd)
+	require.NoError(t, err)
+	assert.Greater(t, len(jsonData), len(data))
+}
+
+func TestMarshalBinaryStorageDataWithoutChecksum(t *testing.T) {
+	t.Parallel()
+
+	data, err := marshalBinaryStorageData(&StorageData{Value: []byte("test"), Modified: time.Now(), Size: 4})
+	require.NoError(t, err)
+	assert.Equal(t, byte(0), data[2])
+
+	sd, err := unmarshalStorageData(data)
+	require.NoError(t, err)
+	assert.Empty(t, sd.Checksum)
+	assert.Equal(t, []byte("test"), sd.Value)
+
+	_, err = marshalBinaryStorageData(&StorageData{Checksum: []byte("short")})
+	assert.ErrorContains(t, err, "invalid checksum length")
+}
+
+func TestUnmarshalLegacyJSONStorageData(t *testing.T) {
+	t.Parallel()
+
+	data := []byte(`{"value":"dGVzdA==","modified":"2024-01-02T03:04:05Z","size":4,"compression":0,"encryption":0}`)
+
+	sd, err := unmarshalStorageData(data)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("test"), sd.Value)
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), sd.Modified.UTC())
+	assert.Equal(t, int64(4), sd.Size)
+}
+
+func TestUnmarshalInvalidBinaryStorageData(t *testing.T) {
+	t.Parallel()
+
+	valid, err := marshalBinaryStorageData(&StorageData{Value: []byte("test"), Modified: time.Now(), Size: 4})
+	require.NoError(t, err)
+
+	t.Run("truncated header", func(t *testing.T) {
+		_, err := unmarshalStorageData(valid[:binaryEnvelopeHeaderSize-1])
+		assert.ErrorContains(t, err, "truncated binary envelope")
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		data := append([]byte{}, valid...)
+		data[1] = binaryEnvelopeVersion + 1
+		_, err := unmarshalStorageData(data)
+		assert.ErrorContains(t, err, "unsupported binary envelope version")
+	})
+
+	t.Run("truncated checksum", func(t *testing.T) {
+		data := append([]byte{}, valid[:binaryEnvelopeHeaderSize]...)
+		data[2] = binaryEnvelopeFlagChecksum
+		data = append(data, make([]byte, sha256.Size-1)...)
+		_, err := unmarshalStorageData(data)
+		assert.ErrorContains(t, err, "truncated binary envelope")
+	})
+
+	t.Run("unsupported flags", func(t *testing.T) {
+		data := append([]byte{}, valid...)
+		data[2] = 0x80
+		_, err := unmarshalStorageData(data)
+		assert.ErrorContains(t, err, "unsupported binary envelope flags")
+	})
+}
@@ -0,0 +1,107 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Maximum number of expired keys removed from the directory index per call to pruneExpiredKeys
+const expiryPruneBatchSize = 100
+
+// KeyTTL configures the time-to-live applied to stored keys matching Pattern.
+type KeyTTL struct {
+	// Pattern A path.Match pattern matched against the storage key, e.g. "ocsp/*".
+	// Note that "*" does not match the "/" path separator.
+	Pattern string `json:"pattern"`
+	// TTL The time-to-live of matching keys, e.g. "7d" or "2160h".
+	TTL caddy.Duration `json:"ttl"`
+}
+
+// keyTTL returns the time-to-live of the first TTL pattern matching key, or 0 if none match.
+func (rs *RedisStorage) keyTTL(key string) time.Duration {
+	for _, keyTTL := range rs.TTL {
+		// Patterns were already validated in finalizeConfiguration
+		if matched, _ := path.Match(keyTTL.Pattern, key); matched {
+			return time.Duration(keyTTL.TTL)
+		}
+	}
+	return 0
+}
+
+// validateTTL checks all configured TTL patterns and durations.
+func (rs *RedisStorage) validateTTL() error {
+	for _, keyTTL := range rs.TTL {
+		if _, err := path.Match(keyTTL.Pattern, ""); err != nil || keyTTL.Pattern == "" {
+			return fmt.Errorf("invalid ttl pattern: %q", keyTTL.Pattern)
+		}
+		if keyTTL.TTL <= 0 {
+			return fmt.Errorf("invalid ttl value for pattern %q: must be greater than zero", keyTTL.Pattern)
+		}
+	}
+	return nil
+}
+
+// expiryIndexKey returns the Redis key of the Sorted Set recording the expiry time of every
+// stored key with a TTL, used to remove expired keys from the directory index.
+func (rs *RedisStorage) expiryIndexKey() string {
+	return rs.KeyPrefix + ":expiry"
+}
+
+// recordExpiry records or clears the expiry time of redisKey in the expiry index.
+func (rs *RedisStorage) recordExpiry(ctx context.Context, redisKey string, ttl time.Duration) error {
+	if ttl > 0 {
+		expiry := float64(time.Now().Add(ttl).Unix())
+		return rs.client.ZAdd(ctx, rs.expiryIndexKey(), redis.Z{Score: expiry, Member: redisKey}).Err()
+	}
+	return rs.client.ZRem(ctx, rs.expiryIndexKey(), redisKey).Err()
+}
+
+// pruneExpiredKeys removes keys that have expired from the directory index. At most
+// expiryPruneBatchSize keys are processed per call. Returns the number of keys removed.
+func (rs *RedisStorage) pruneExpiredKeys(ctx context.Context) (int, error) {
+
+	var pruned = 0
+	var indexKey = rs.expiryIndexKey()
+
+	expired, err := rs.client.ZRangeByScore(ctx, indexKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().Unix(), 10),
+		Count: expiryPruneBatchSize,
+	}).Result()
+	if err != nil {
+		return pruned, fmt.Errorf("Unable to get range on sorted set '%s': %v", indexKey, err)
+	}
+
+	for _, redisKey := range expired {
+		// Keys about to expire, or stored again, are pruned by a later call
+		removed, err := rs.deleteAbsentDirectoryRecord(ctx, redisKey, false)
+		if err != nil {
+			return pruned, err
+		}
+		if removed {
+			pruned++
+		}
+	}
+
+	return pruned, nil
+}
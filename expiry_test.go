@@ -0,0 +1,96 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisStorage_KeyTTL(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+	rs.TTL = []KeyTTL{
+		{Pattern: TestKeyExamplePath + "/*.json", TTL: caddy.Duration(time.Hour)},
+		{Pattern: TestKeyExamplePath + "/*", TTL: caddy.Duration(24 * time.Hour)},
+	}
+
+	for _, layout := range []StorageLayout{StorageLayoutString, StorageLayoutHash} {
+		rs.StorageLayout = layout
+
+		err := rs.Store(ctx, TestKeyExampleJson, TestValueJson)
+		require.NoError(t, err)
+		err = rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+		require.NoError(t, err)
+		err = rs.Store(ctx, TestKeyLock, []byte("lock"))
+		require.NoError(t, err)
+
+		// First matching pattern applies
+		assert.InDelta(t, time.Hour, rs.client.PTTL(ctx, rs.prefixKey(TestKeyExampleJson)).Val(), float64(time.Minute))
+		assert.InDelta(t, 24*time.Hour, rs.client.PTTL(ctx, rs.prefixKey(TestKeyExampleCrt)).Val(), float64(time.Minute))
+		// Keys not matching any pattern never expire
+		assert.Equal(t, time.Duration(-1), rs.client.PTTL(ctx, rs.prefixKey(TestKeyLock)).Val())
+
+		members, err := rs.client.ZRange(ctx, rs.expiryIndexKey(), 0, -1).Result()
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{rs.prefixKey(TestKeyExampleJson), rs.prefixKey(TestKeyExampleCrt)}, members)
+	}
+}
+
+func TestRedisStorage_PruneExpiredKeys(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+	rs.TTL = []KeyTTL{{Pattern: TestKeyExamplePath + "/*", TTL: caddy.Duration(time.Hour)}}
+
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	require.NoError(t, err)
+	err = rs.Store(ctx, TestKeyExampleKey, TestValueKey)
+	require.NoError(t, err)
+
+	// Simulate expiry of the certificate key
+	expiredKey := rs.prefixKey(TestKeyExampleCrt)
+	err = rs.client.Del(ctx, expiredKey).Err()
+	require.NoError(t, err)
+	err = rs.client.ZAdd(ctx, rs.expiryIndexKey(), redis.Z{Score: float64(time.Now().Add(-time.Minute).Unix()), Member: expiredKey}).Err()
+	require.NoError(t, err)
+
+	keys, err := rs.List(ctx, TestKeyExamplePath, false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{TestKeyExampleCrt, TestKeyExampleKey}, keys)
+
+	pruned, err := rs.pruneExpiredKeys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+
+	keys, err = rs.List(ctx, TestKeyExamplePath, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{TestKeyExampleKey}, keys)
+
+	members, err := rs.client.ZRange(ctx, rs.expiryIndexKey(), 0, -1).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []string{rs.prefixKey(TestKeyExampleKey)}, members)
+
+	// Storing a key without a TTL removes it from the expiry index
+	rs.TTL = []KeyTTL{{Pattern: "locks/*", TTL: caddy.Duration(time.Hour)}}
+	err = rs.Store(ctx, TestKeyExampleKey, TestValueKey)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(-1), rs.client.PTTL(ctx, rs.prefixKey(TestKeyExampleKey)).Val())
+	assert.Zero(t, rs.client.ZCard(ctx, rs.expiryIndexKey()).Val())
+}
@@ -0,0 +1,267 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// StorageData field names used by the "hash" storage layout
+const (
+	hashFieldValue       = "value"
+	hashFieldModified    = "modified"
+	hashFieldSize        = "size"
+	hashFieldCompression = "compression"
+	hashFieldEncryption  = "encryption"
+	hashFieldChecksum    = "checksum"
+)
+
+// readStorageData reads the StorageData stored at redisKey. Values stored using either
+// storage layout are readable regardless of the configured layout, the configured layout
+// is only tried first.
+func (rs *RedisStorage) readStorageData(ctx context.Context, c redis.Cmdable, redisKey string) (*StorageData, error) {
+	if rs.StorageLayout == StorageLayoutHash {
+		sd, err := readHashStorageData(ctx, c, redisKey)
+		if isWrongTypeError(err) {
+			return readStringStorageData(ctx, c, redisKey)
+		}
+		return sd, err
+	}
+	sd, err := readStringStorageData(ctx, c, redisKey)
+	if isWrongTypeError(err) {
+		return readHashStorageData(ctx, c, redisKey)
+	}
+	return sd, err
+}
+
+// queueStorageData queues the commands writing sd to redisKey using the configured storage layout.
+// The key expires after ttl unless ttl is 0.
+func (rs *RedisStorage) queueStorageData(ctx context.Context, pipe redis.Pipeliner, redisKey string, sd *StorageData, ttl time.Duration) error {
+	if rs.StorageLayout == StorageLayoutHash {
+		// Remove any value previously stored using the string layout
+		pipe.Del(ctx, redisKey)
+		fields := []any{
+			hashFieldValue, sd.Value,
+			hashFieldModified, sd.Modified.UnixNano(),
+			hashFieldSize, sd.Size,
+			hashFieldCompression, sd.Compression,
+			hashFieldEncryption, sd.Encryption,
+		}
+		if len(sd.Checksum) > 0 {
+			fields = append(fields, hashFieldChecksum, sd.Checksum)
+		}
+		pipe.HSet(ctx, redisKey, fields...)
+		if ttl > 0 {
+			pipe.PExpire(ctx, redisKey, ttl)
+		}
+		return nil
+	}
+	data, err := rs.marshalStorageData(sd)
+	if err != nil {
+		return err
+	}
+	pipe.Set(ctx, redisKey, data, ttl)
+	return nil
+}
+
+// statStorageData returns the modified time and size of the value stored at redisKey.
+// Values stored using the "hash" layout are inspected without transferring the value itself.
+func (rs *RedisStorage) statStorageData(ctx context.Context, redisKey string) (time.Time, int64, error) {
+	if rs.StorageLayout == StorageLayoutHash {
+		fields, err := rs.client.HMGet(ctx, redisKey, hashFieldModified, hashFieldSize).Result()
+		if err == nil {
+			if fields[0] == nil || fields[1] == nil {
+				return time.Time{}, 0, fs.ErrNotExist
+			}
+			return parseHashMetadata(fields[0].(string), fields[1].(string))
+		}
+		if !isWrongTypeError(err) {
+			return time.Time{}, 0, err
+		}
+	}
+	sd, err := rs.readStorageData(ctx, rs.client, redisKey)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	return sd.Modified, sd.Size, nil
+}
+
+func readStringStorageData(ctx context.Context, c redis.Cmdable, redisKey string) (*StorageData, error) {
+	return parseStringStorageData(c.Get(ctx, redisKey))
+}
+
+// parseStringStorageData decodes the result of a GET command of a value stored using the "string" layout.
+func parseStringStorageData(cmd *redis.StringCmd) (*StorageData, error) {
+
+	data, err := cmd.Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, fs.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	} else if data == nil {
+		return nil, fs.ErrNotExist
+	}
+
+	sd, err := unmarshalStorageData(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal value: %v", err)
+	}
+
+	return sd, nil
+}
+
+func readHashStorageData(ctx context.Context, c redis.Cmdable, redisKey string) (*StorageData, error) {
+	return parseHashStorageData(c.HGetAll(ctx, redisKey))
+}
+
+// parseHashStorageData decodes the result of an HGETALL command of a value stored using the "hash" layout.
+func parseHashStorageData(cmd *redis.MapStringStringCmd) (*StorageData, error) {
+
+	fields, err := cmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, fs.ErrNotExist
+	}
+
+	value, ok := fields[hashFieldValue]
+	if !ok {
+		return nil, fmt.Errorf("Unable to unmarshal value: missing '%s' field", hashFieldValue)
+	}
+	modified, size, err := parseHashMetadata(fields[hashFieldModified], fields[hashFieldSize])
+	if err != nil {
+		return nil, err
+	}
+	compression, err := strconv.Atoi(fields[hashFieldCompression])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal value: invalid '%s' field", hashFieldCompression)
+	}
+	encryption, err := strconv.Atoi(fields[hashFieldEncryption])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal value: invalid '%s' field", hashFieldEncryption)
+	}
+
+	sd := &StorageData{
+		Value:       []byte(value),
+		Modified:    modified,
+		Size:        size,
+		Compression: compression,
+		Encryption:  encryption,
+	}
+	if checksum, ok := fields[hashFieldChecksum]; ok {
+		sd.Checksum = []byte(checksum)
+	}
+
+	return sd, nil
+}
+
+func parseHashMetadata(modifiedField, sizeField string) (time.Time, int64, error) {
+	modified, err := strconv.ParseInt(modifiedField, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("Unable to unmarshal value: invalid '%s' field", hashFieldModified)
+	}
+	size, err := strconv.ParseInt(sizeField, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("Unable to unmarshal value: invalid '%s' field", hashFieldSize)
+	}
+	return time.Unix(0, modified), size, nil
+}
+
+func isWrongTypeError(err error) bool {
+	return err != nil && redis.HasErrorPrefix(err, "WRONGTYPE")
+}
+
+// MigrateLayout rewrites every value stored under the key prefix that does not use the
+// configured storage layout. Each value is rewritten within a transaction watching the key,
+// so values concurrently updated by other Caddy instances are never overwritten.
+// Returns the number of values migrated.
+func (rs *RedisStorage) MigrateLayout(ctx context.Context) (int, error) {
+
+	var pattern = rs.storageKeyPattern()
+	var scanCount int64 = 500
+	var migrated atomic.Int64
+
+	sourceType := "hash"
+	if rs.StorageLayout == StorageLayoutHash {
+		sourceType = "string"
+	}
+
+	// Keys are distributed across the master nodes in cluster mode
+	err := rs.forEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+
+		var pointer uint64 = 0
+
+		for {
+			// Scan for keys matching the search query and iterate until all found
+			keys, nextPointer, err := client.Scan(ctx, pointer, pattern, scanCount).Result()
+			if err != nil {
+				return fmt.Errorf("Unable to scan path %s: %v", pattern, err)
+			}
+
+			for _, key := range keys {
+				// Proceed only if key is stored using the other storage layout
+				if rs.client.Type(ctx, key).Val() != sourceType {
+					continue
+				}
+
+				err := rs.client.Watch(ctx, func(tx *redis.Tx) error {
+					sd, err := rs.readStorageData(ctx, tx, key)
+					if err != nil {
+						return err
+					}
+					// Preserve the remaining time-to-live of expiring keys
+					ttl, err := tx.PTTL(ctx, key).Result()
+					if err != nil {
+						return err
+					}
+					_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+						return rs.queueStorageData(ctx, pipe, key, sd, max(ttl, 0))
+					})
+					return err
+				}, key)
+
+				if errors.Is(err, fs.ErrNotExist) || errors.Is(err, redis.TxFailedErr) {
+					// Key was deleted or modified concurrently and no longer needs migration
+					continue
+				} else if err != nil {
+					// Not a storage value (e.g. a lock) or unreadable, leave it untouched
+					if rs.logger != nil {
+						rs.logger.Infof("Unable to migrate key '%s': %v", key, err)
+					}
+					continue
+				}
+
+				migrated.Add(1)
+			}
+
+			// End of results reached
+			if nextPointer == 0 {
+				return nil
+			}
+			pointer = nextPointer
+		}
+	})
+
+	return int(migrated.Load()), err
+}
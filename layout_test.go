@@ -0,0 +1,161 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisStorage_HashLayoutStoreLoadStat(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+	rs.StorageLayout = StorageLayoutHash
+
+	startTime := time.Now()
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	endTime := time.Now()
+	require.NoError(t, err)
+
+	assert.Equal(t, "hash", rs.client.Type(ctx, rs.prefixKey(TestKeyExampleCrt)).Val())
+
+	loadedValue, err := rs.Load(ctx, TestKeyExampleCrt)
+	assert.NoError(t, err)
+	assert.Equal(t, TestValueCrt, loadedValue)
+
+	stat, err := rs.Stat(ctx, TestKeyExampleCrt)
+	assert.NoError(t, err)
+	assert.Equal(t, TestKeyExampleCrt, stat.Key)
+	assert.WithinRange(t, stat.Modified, startTime, endTime)
+	assert.Equal(t, int64(len(TestValueCrt)), stat.Size)
+	assert.True(t, stat.IsTerminal)
+
+	_, err = rs.Stat(ctx, TestKeyExampleKey)
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	keys, err := rs.List(ctx, "", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{TestKeyExampleCrt}, keys)
+
+	err = rs.Delete(ctx, TestKeyExampleCrt)
+	assert.NoError(t, err)
+	assert.False(t, rs.Exists(ctx, TestKeyExampleCrt))
+}
+
+func TestRedisStorage_MixedLayouts(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	// Value stored using the string layout
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	require.NoError(t, err)
+
+	// Value stored using the hash layout
+	rs.StorageLayout = StorageLayoutHash
+	err = rs.Store(ctx, TestKeyExampleKey, TestValueKey)
+	require.NoError(t, err)
+
+	for _, layout := range []StorageLayout{StorageLayoutString, StorageLayoutHash} {
+		rs.StorageLayout = layout
+
+		loadedValue, err := rs.Load(ctx, TestKeyExampleCrt)
+		assert.NoError(t, err)
+		assert.Equal(t, TestValueCrt, loadedValue)
+
+		loadedValue, err = rs.Load(ctx, TestKeyExampleKey)
+		assert.NoError(t, err)
+		assert.Equal(t, TestValueKey, loadedValue)
+
+		stat, err := rs.Stat(ctx, TestKeyExampleCrt)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(TestValueCrt)), stat.Size)
+
+		stat, err = rs.Stat(ctx, TestKeyExampleKey)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(TestValueKey)), stat.Size)
+	}
+
+	// Overwriting a string value using the hash layout replaces it
+	rs.StorageLayout = StorageLayoutHash
+	err = rs.Store(ctx, TestKeyExampleCrt, TestValueJson)
+	require.NoError(t, err)
+	assert.Equal(t, "hash", rs.client.Type(ctx, rs.prefixKey(TestKeyExampleCrt)).Val())
+
+	// Overwriting a hash value using the string layout replaces it
+	rs.StorageLayout = StorageLayoutString
+	err = rs.Store(ctx, TestKeyExampleKey, TestValueJson)
+	require.NoError(t, err)
+	assert.Equal(t, "string", rs.client.Type(ctx, rs.prefixKey(TestKeyExampleKey)).Val())
+}
+
+func TestRedisStorage_MigrateLayout(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	require.NoError(t, err)
+	err = rs.Store(ctx, TestKeyExampleKey, TestValueKey)
+	require.NoError(t, err)
+	statBefore, err := rs.Stat(ctx, TestKeyExampleCrt)
+	require.NoError(t, err)
+
+	// Keys of other applications sharing the key prefix must be left untouched
+	foreignKey := TestKeyPrefix + "-copy"
+	data, err := rs.client.Get(ctx, rs.prefixKey(TestKeyExampleKey)).Bytes()
+	require.NoError(t, err)
+	err = rs.client.Set(ctx, foreignKey, data, 0).Err()
+	require.NoError(t, err)
+
+	// Lock keys are plain strings which must be left untouched
+	err = rs.Lock(ctx, TestKeyLock)
+	require.NoError(t, err)
+	defer func() { _ = rs.Unlock(ctx, TestKeyLock) }()
+
+	rs.StorageLayout = StorageLayoutHash
+	migrated, err := rs.MigrateLayout(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, migrated)
+
+	assert.Equal(t, "hash", rs.client.Type(ctx, rs.prefixKey(TestKeyExampleCrt)).Val())
+	assert.Equal(t, "hash", rs.client.Type(ctx, rs.prefixKey(TestKeyExampleKey)).Val())
+	assert.Equal(t, "string", rs.client.Type(ctx, rs.prefixLock(TestKeyLock)).Val())
+	assert.Equal(t, "string", rs.client.Type(ctx, foreignKey).Val())
+
+	// Modified time is preserved by the migration
+	statAfter, err := rs.Stat(ctx, TestKeyExampleCrt)
+	assert.NoError(t, err)
+	assert.True(t, statBefore.Modified.Equal(statAfter.Modified))
+
+	loadedValue, err := rs.Load(ctx, TestKeyExampleKey)
+	assert.NoError(t, err)
+	assert.Equal(t, TestValueKey, loadedValue)
+
+	// Running the migration again is a no-op
+	migrated, err = rs.MigrateLayout(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, migrated)
+
+	// Migrating back to the string layout
+	rs.StorageLayout = StorageLayoutString
+	migrated, err = rs.MigrateLayout(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, migrated)
+	assert.Equal(t, "string", rs.client.Type(ctx, rs.prefixKey(TestKeyExampleCrt)).Val())
+}
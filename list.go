@@ -0,0 +1,371 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Default number of directory index records fetched per page by ListIter
+const defaultListPageSize = 1000
+
+// listRecursiveScript returns the relative paths of all terminal keys below the directory
+// Sorted Set KEYS[1], traversing child directories depth-first in a single round trip.
+var listRecursiveScript = redis.NewScript(`
+local results = {}
+local function walk(key, relative)
+	local members = redis.call('ZRANGE', key, 0, -1)
+	for _, member in ipairs(members) do
+		if string.sub(member, -1) == '/' then
+			local name = string.sub(member, 1, -2)
+			walk(key .. '/' .. name, relative .. name .. '/')
+		else
+			results[#results + 1] = relative .. member
+		end
+	end
+end
+walk(KEYS[1], '')
+return results
+`)
+
+// isCluster reports whether keys are distributed across several nodes, in which case a
+// script cannot access every directory Sorted Set.
+func (rs *RedisStorage) isCluster() bool {
+	_, ok := rs.client.(*redis.ClusterClient)
+	return ok && rs.ClientType != "failover"
+}
+
+// supportsTransactions reports whether a transaction may access keys in different hash slots.
+// Cluster clients reject such transactions, including the client used in failover mode.
+func (rs *RedisStorage) supportsTransactions() bool {
+	_, ok := rs.client.(*redis.ClusterClient)
+	return !ok
+}
+
+// listRecursive returns all terminal keys below dir. A Lua script traverses the directory
+// index on the server, while in cluster mode each level of the tree is fetched using a
+// pipeline of ZRANGE commands.
+func (rs *RedisStorage) listRecursive(ctx context.Context, dir string) ([]string, error) {
+
+	var currKey = rs.prefixKey(dir)
+	var relativeKeys []string
+	var err error
+
+	if rs.isCluster() {
+		relativeKeys, err = rs.listRecursivePipelined(ctx, currKey)
+	} else {
+		relativeKeys, err = listRecursiveScript.Run(ctx, rs.client, []string{currKey}).StringSlice()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list sorted set '%s': %v", currKey, err)
+	}
+
+	keyList := make([]string, 0, len(relativeKeys))
+	for _, relativeKey := range relativeKeys {
+		// Decrypt child key names if key name encryption enabled
+		childKey, err := rs.decodeKeyPath(relativeKey)
+		if err != nil {
+			return nil, err
+		}
+		// Reconstruct the full path of child key
+		keyList = append(keyList, path.Join(dir, childKey))
+	}
+
+	return keyList, nil
+}
+
+// listRecursivePipelined returns the relative paths of all terminal keys below the directory
+// Sorted Set currKey, fetching the directories of each level of the tree in a single pipeline.
+// The keys are returned in the same depth-first order as listRecursiveScript.
+func (rs *RedisStorage) listRecursivePipelined(ctx context.Context, currKey string) ([]string, error) {
+
+	// Members of each directory, keyed by relative path with a trailing "/"
+	var members = map[string][]string{}
+	var level = []string{""}
+
+	for len(level) > 0 {
+		cmds := make([]*redis.StringSliceCmd, len(level))
+		_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, relativeDir := range level {
+				cmds[i] = pipe.ZRange(ctx, path.Join(currKey, relativeDir), 0, -1)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var nextLevel []string
+		for i, relativeDir := range level {
+			members[relativeDir] = cmds[i].Val()
+			for _, member := range members[relativeDir] {
+				if strings.HasSuffix(member, keyPathSeparator) {
+					nextLevel = append(nextLevel, relativeDir+member)
+				}
+			}
+		}
+		level = nextLevel
+	}
+
+	var relativeKeys []string
+	var walk func(relativeDir string)
+	walk = func(relativeDir string) {
+		for _, member := range members[relativeDir] {
+			if strings.HasSuffix(member, keyPathSeparator) {
+				walk(relativeDir + member)
+			} else {
+				relativeKeys = append(relativeKeys, relativeDir+member)
+			}
+		}
+	}
+	walk("")
+
+	return relativeKeys, nil
+}
+
+// ListIter returns an iterator over the same keys as List, fetching the records of each
+// directory in pages of list_page_size records, so that memory use is bounded regardless of the
+// number of keys. Iteration stops after the first error, which is yielded with an empty key.
+// Keys stored or deleted during iteration may be skipped or returned twice.
+func (rs *RedisStorage) ListIter(ctx context.Context, dir string, recursive bool) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		rs.listIter(ctx, dir, recursive, yield)
+	}
+}
+
+// listIter yields the keys below dir, returning false when iteration must stop.
+func (rs *RedisStorage) listIter(ctx context.Context, dir string, recursive bool, yield func(string, error) bool) bool {
+
+	var currKey = rs.prefixKey(dir)
+	var pageSize = rs.listPageSize()
+
+	for start := int64(0); ; start += pageSize {
+		// Obtain a page of direct children stored in the Sorted Set
+		keys, err := rs.client.ZRange(ctx, currKey, start, start+pageSize-1).Result()
+		if err != nil {
+			yield("", fmt.Errorf("Unable to get range on sorted set '%s': %v", currKey, err))
+			return false
+		}
+
+		// Iterate over each child key
+		for _, k := range keys {
+			// Directory keys will have a "/" suffix
+			trimmedKey := strings.TrimSuffix(k, keyPathSeparator)
+			// Decrypt child key name if key name encryption enabled
+			childKey, err := rs.decodeKeyPath(trimmedKey)
+			if err != nil {
+				yield("", err)
+				return false
+			}
+			// Reconstruct the full path of child key
+			fullPathKey := path.Join(dir, childKey)
+			// If current key is a directory
+			if recursive && k != trimmedKey {
+				// Recursively traverse all child directories
+				if !rs.listIter(ctx, fullPathKey, recursive, yield) {
+					return false
+				}
+			} else if !yield(fullPathKey, nil) {
+				return false
+			}
+		}
+
+		// End of the Sorted Set reached
+		if int64(len(keys)) < pageSize {
+			return true
+		}
+	}
+}
+
+// listPageSize returns the configured number of records fetched per page by ListIter.
+func (rs *RedisStorage) listPageSize() int64 {
+	if rs.ListPageSize == "" {
+		return defaultListPageSize
+	}
+	// Was already sanity-checked in finalizeConfiguration
+	size, _ := strconv.ParseInt(rs.ListPageSize, 10, 64)
+	return size
+}
+
+// ListModifiedOptions control which keys are returned by ListModified and in which order.
+type ListModifiedOptions struct {
+	// Recursive includes keys in all child directories
+	Recursive bool
+	// Since excludes keys modified before this time, if not zero
+	Since time.Time
+	// Until excludes keys modified after this time, if not zero
+	Until time.Time
+	// NewestFirst returns the most recently modified keys first
+	NewestFirst bool
+	// Limit is the maximum number of keys returned, if greater than zero
+	Limit int
+}
+
+// ModifiedKey is a key returned by ListModified with its modification time.
+type ModifiedKey struct {
+	Key      string    `json:"key"`
+	Modified time.Time `json:"modified"`
+}
+
+// ListModified returns the terminal keys below dir modified within the time window of opts,
+// ordered by modification time, using the scores of the directory index instead of loading
+// each value. Modification times have a precision of one second.
+func (rs RedisStorage) ListModified(ctx context.Context, dir string, opts ListModifiedOptions) ([]ModifiedKey, error) {
+
+	var currKey = rs.prefixKey(dir)
+	var members []redis.Z
+	var err error
+
+	if opts.Recursive {
+		members, err = rs.listModifiedRecursive(ctx, currKey, opts)
+	} else {
+		members, err = rs.client.ZRangeArgsWithScores(ctx, redis.ZRangeArgs{
+			Key:     currKey,
+			Start:   modifiedScoreMin(opts.Since),
+			Stop:    modifiedScoreMax(opts.Until),
+			ByScore: true,
+		}).Result()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get range on sorted set '%s': %v", currKey, err)
+	}
+
+	var keyList []ModifiedKey
+	for _, z := range members {
+		member := z.Member.(string)
+		// Directory keys will have a "/" suffix
+		if strings.HasSuffix(member, keyPathSeparator) {
+			continue
+		}
+		// Decrypt child key names if key name encryption enabled
+		childKey, err := rs.decodeKeyPath(member)
+		if err != nil {
+			return nil, err
+		}
+		keyList = append(keyList, ModifiedKey{
+			Key:      path.Join(dir, childKey),
+			Modified: time.Unix(int64(z.Score), 0),
+		})
+	}
+
+	slices.SortStableFunc(keyList, func(a, b ModifiedKey) int {
+		if c := a.Modified.Compare(b.Modified); c != 0 {
+			if opts.NewestFirst {
+				return -c
+			}
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	if opts.Limit > 0 && len(keyList) > opts.Limit {
+		keyList = keyList[:opts.Limit]
+	}
+
+	return keyList, nil
+}
+
+// listModifiedRecursive returns the terminal keys below the directory Sorted Set currKey with
+// scores in the time window of opts, relative to currKey. Records of each directory are fetched
+// by score, while its subdirectories are found by a separate ZSCAN matching directory records
+// regardless of their score. The directories of each level of the tree are fetched in a single
+// pipeline, so that it also works in cluster mode.
+func (rs *RedisStorage) listModifiedRecursive(ctx context.Context, currKey string, opts ListModifiedOptions) ([]redis.Z, error) {
+
+	var since, until = modifiedScoreMin(opts.Since), modifiedScoreMax(opts.Until)
+	var dirPattern = "*" + keyPathSeparator
+	var scanCount = rs.listPageSize()
+	var results []redis.Z
+	var level = []string{""}
+
+	for len(level) > 0 {
+		rangeCmds := make([]*redis.ZSliceCmd, len(level))
+		scanCmds := make([]*redis.ScanCmd, len(level))
+		_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, relativeDir := range level {
+				dirKey := path.Join(currKey, relativeDir)
+				rangeCmds[i] = pipe.ZRangeArgsWithScores(ctx, redis.ZRangeArgs{
+					Key:     dirKey,
+					Start:   since,
+					Stop:    until,
+					ByScore: true,
+				})
+				scanCmds[i] = pipe.ZScan(ctx, dirKey, 0, dirPattern, scanCount)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var nextLevel []string
+		for i, relativeDir := range level {
+			for _, z := range rangeCmds[i].Val() {
+				member := z.Member.(string)
+				// Directory scores are not related to the modification time of their children
+				if !strings.HasSuffix(member, keyPathSeparator) {
+					results = append(results, redis.Z{Score: z.Score, Member: relativeDir + member})
+				}
+			}
+
+			// Continue scanning large directories, whose subdirectories may be returned repeatedly
+			var subdirs []string
+			members, cursor := scanCmds[i].Val()
+			for {
+				// Members are followed by their scores
+				for j := 0; j < len(members); j += 2 {
+					subdirs = append(subdirs, relativeDir+members[j])
+				}
+				if cursor == 0 {
+					break
+				}
+				dirKey := path.Join(currKey, relativeDir)
+				if members, cursor, err = rs.client.ZScan(ctx, dirKey, cursor, dirPattern, scanCount).Result(); err != nil {
+					return nil, err
+				}
+			}
+			slices.Sort(subdirs)
+			nextLevel = append(nextLevel, slices.Compact(subdirs)...)
+		}
+		level = nextLevel
+	}
+
+	return results, nil
+}
+
+// modifiedScoreMin returns the lowest directory index score modified at or after t.
+func modifiedScoreMin(t time.Time) string {
+	if t.IsZero() {
+		return "-inf"
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// modifiedScoreMax returns the highest directory index score modified at or before t.
+func modifiedScoreMax(t time.Time) string {
+	if t.IsZero() {
+		return "+inf"
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
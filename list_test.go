@@ -0,0 +1,217 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"fmt"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisStorage_ListRecursive(t *testing.T) {
+
+	for _, encryptKeyNames := range []bool{false, true} {
+
+		rs, ctx := provisionRedisStorage(t)
+		if encryptKeyNames {
+			rs.EncryptKeyNames = true
+			require.NoError(t, rs.initKeyNameCipher())
+		}
+
+		expected := []string{
+			TestKeyExampleCrt,
+			TestKeyExampleKey,
+			TestKeyExampleJson,
+			TestKeyAcmePath + "/other.com/other.com.crt",
+			TestKeyCertPath + "/local/local.crt",
+		}
+		for _, key := range expected {
+			err := rs.Store(ctx, key, TestValueCrt)
+			require.NoError(t, err)
+		}
+		err := rs.Store(ctx, "ocsp/example.com", TestValueKey)
+		require.NoError(t, err)
+
+		keys, err := rs.List(ctx, TestKeyCertPath, true)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, expected, keys)
+
+		// Cluster mode fetches each level of the tree using a pipeline, in the same order
+		relativeKeys, err := rs.listRecursivePipelined(ctx, rs.prefixKey(TestKeyCertPath))
+		require.NoError(t, err)
+		scriptKeys, err := listRecursiveScript.Run(ctx, rs.client, []string{rs.prefixKey(TestKeyCertPath)}).StringSlice()
+		require.NoError(t, err)
+		assert.Equal(t, scriptKeys, relativeKeys)
+		assert.Len(t, relativeKeys, len(expected))
+
+		keys, err = rs.List(ctx, TestKeyAcmePath+"/other.com", true)
+		require.NoError(t, err)
+		assert.Equal(t, []string{TestKeyAcmePath + "/other.com/other.com.crt"}, keys)
+
+		keys, err = rs.List(ctx, "", true)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, append(expected, "ocsp/example.com"), keys)
+
+		keys, err = rs.List(ctx, "missing", true)
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+	}
+}
+
+func TestRedisStorage_ListIter(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+	rs.ListPageSize = "2"
+
+	for i := range 7 {
+		err := rs.Store(ctx, fmt.Sprintf("%s/domain%d.com/domain%d.com.crt", TestKeyAcmePath, i, i), TestValueCrt)
+		require.NoError(t, err)
+	}
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	require.NoError(t, err)
+	err = rs.Store(ctx, TestKeyExampleKey, TestValueKey)
+	require.NoError(t, err)
+
+	for _, recursive := range []bool{false, true} {
+		expected, err := rs.List(ctx, TestKeyAcmePath, recursive)
+		require.NoError(t, err)
+
+		var keys []string
+		for key, err := range rs.ListIter(ctx, TestKeyAcmePath, recursive) {
+			require.NoError(t, err)
+			keys = append(keys, key)
+		}
+		assert.Equal(t, expected, keys)
+	}
+
+	// Iteration stops early when requested
+	var count int
+	for _, err := range rs.ListIter(ctx, "", true) {
+		require.NoError(t, err)
+		if count++; count == 3 {
+			break
+		}
+	}
+	assert.Equal(t, 3, count)
+
+	// Errors are yielded once, ending iteration
+	err = rs.client.Set(ctx, rs.prefixKey("invalid"), "value", 0).Err()
+	require.NoError(t, err)
+	var errs []error
+	for key, err := range rs.ListIter(ctx, "invalid", false) {
+		assert.Empty(t, key)
+		errs = append(errs, err)
+	}
+	require.Len(t, errs, 1)
+	assert.Error(t, errs[0])
+}
+
+func TestRedisStorage_ListModified(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	modified := map[string]time.Time{
+		TestKeyExampleCrt:  base.Add(3 * time.Hour),
+		TestKeyExampleKey:  base.Add(1 * time.Hour),
+		TestKeyExampleJson: base.Add(2 * time.Hour),
+		TestKeyAcmePath + "/other.com/other.com.crt": base.Add(4 * time.Hour),
+	}
+	for key, ts := range modified {
+		err := rs.Store(ctx, key, TestValueCrt)
+		require.NoError(t, err)
+		// Override the modification time recorded in the directory index
+		err = rs.storeDirectoryRecord(ctx, rs.prefixKey(key), float64(ts.Unix()), false)
+		require.NoError(t, err)
+	}
+
+	keys, err := rs.ListModified(ctx, TestKeyExamplePath, ListModifiedOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []ModifiedKey{
+		{Key: TestKeyExampleKey, Modified: base.Add(1 * time.Hour).Local()},
+		{Key: TestKeyExampleJson, Modified: base.Add(2 * time.Hour).Local()},
+		{Key: TestKeyExampleCrt, Modified: base.Add(3 * time.Hour).Local()},
+	}, keys)
+
+	// Directories are not returned without recursion
+	keys, err = rs.ListModified(ctx, TestKeyAcmePath, ListModifiedOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	keys, err = rs.ListModified(ctx, TestKeyCertPath, ListModifiedOptions{
+		Recursive:   true,
+		Since:       base.Add(2 * time.Hour),
+		NewestFirst: true,
+	})
+	require.NoError(t, err)
+	require.Len(t, keys, 3)
+	assert.Equal(t, TestKeyAcmePath+"/other.com/other.com.crt", keys[0].Key)
+	assert.Equal(t, TestKeyExampleCrt, keys[1].Key)
+	assert.Equal(t, TestKeyExampleJson, keys[2].Key)
+
+	keys, err = rs.ListModified(ctx, TestKeyCertPath, ListModifiedOptions{
+		Recursive: true,
+		Until:     base.Add(3 * time.Hour),
+		Limit:     2,
+	})
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, TestKeyExampleKey, keys[0].Key)
+	assert.Equal(t, TestKeyExampleJson, keys[1].Key)
+
+	keys, err = rs.ListModified(ctx, TestKeyExamplePath, ListModifiedOptions{
+		Since: base.Add(2 * time.Hour),
+		Until: base.Add(2 * time.Hour),
+	})
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, TestKeyExampleJson, keys[0].Key)
+}
+
+func TestRedisStorage_ListModifiedLargeDirectory(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+	rs.ListPageSize = "5"
+
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	var expected []string
+	for i := range 30 {
+		key := fmt.Sprintf("%s/domain%02d.com/domain%02d.com.crt", TestKeyAcmePath, i, i)
+		err := rs.Store(ctx, key, TestValueCrt)
+		require.NoError(t, err)
+		err = rs.storeDirectoryRecord(ctx, rs.prefixKey(key), float64(base.Add(time.Duration(i)*time.Minute).Unix()), false)
+		require.NoError(t, err)
+		if i >= 10 {
+			expected = append(expected, key)
+		}
+	}
+
+	// Subdirectories are followed regardless of the score of their records
+	err := rs.client.ZAdd(ctx, rs.prefixKey(TestKeyCertPath), redis.Z{Score: 0, Member: path.Base(TestKeyAcmePath) + "/"}).Err()
+	require.NoError(t, err)
+
+	keys, err := rs.ListModified(ctx, "", ListModifiedOptions{Recursive: true, Since: base.Add(10 * time.Minute)})
+	require.NoError(t, err)
+	var listed []string
+	for _, key := range keys {
+		listed = append(listed, key.Key)
+	}
+	assert.Equal(t, expected, listed)
+}
@@ -0,0 +1,167 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Keyspace notification classes required by the subscriber: keyspace events (K),
+// generic commands such as DEL (g), expired events (x) and evicted events (e)
+const requiredKeyspaceEvents = "Kgxe"
+
+// keyspaceSubscriber holds the keyspace notification subscriptions of every master node.
+type keyspaceSubscriber struct {
+	cancel  context.CancelFunc
+	pubsubs []*redis.PubSub
+	done    chan struct{}
+}
+
+// keyspaceChannelPrefix returns the prefix of the keyspace notification channel of each key.
+func (rs *RedisStorage) keyspaceChannelPrefix() string {
+	return fmt.Sprintf("__keyspace@%s__:", rs.DB)
+}
+
+// keyspaceChannelPattern returns the channel pattern matching keyspace notifications of stored keys.
+func (rs *RedisStorage) keyspaceChannelPattern() string {
+	return rs.keyspaceChannelPrefix() + rs.storageKeyPattern()
+}
+
+// escapeGlobPattern escapes characters having special meaning in Redis glob-style patterns.
+func escapeGlobPattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// startKeyspaceNotifications subscribes to keyspace notifications of stored keys on every
+// master node, removing keys that expire or are evicted or deleted from the directory index.
+func (rs *RedisStorage) startKeyspaceNotifications() error {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pattern := rs.keyspaceChannelPattern()
+
+	var mu sync.Mutex
+	var pubsubs []*redis.PubSub
+
+	subscribe := func(ctx context.Context, client *redis.Client) error {
+		rs.checkKeyspaceEventsConfig(ctx, client)
+
+		pubsub := client.PSubscribe(ctx, pattern)
+		// Wait for confirmation that the subscription was created
+		if _, err := pubsub.Receive(ctx); err != nil {
+			pubsub.Close()
+			return err
+		}
+		mu.Lock()
+		pubsubs = append(pubsubs, pubsub)
+		mu.Unlock()
+		return nil
+	}
+
+	// Keyspace notifications are not propagated between cluster nodes
+	if err := rs.forEachMaster(ctx, subscribe); err != nil {
+		for _, pubsub := range pubsubs {
+			pubsub.Close()
+		}
+		cancel()
+		return fmt.Errorf("Unable to subscribe to keyspace notifications: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, pubsub := range pubsubs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rs.receiveKeyspaceNotifications(ctx, pubsub)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	rs.keyspaceSubscriber = &keyspaceSubscriber{cancel: cancel, pubsubs: pubsubs, done: done}
+	return nil
+}
+
+// stopKeyspaceNotifications closes the keyspace notification subscriptions, if any, and
+// waits for pending notifications to be handled.
+func (rs *RedisStorage) stopKeyspaceNotifications() {
+	if rs.keyspaceSubscriber == nil {
+		return
+	}
+	rs.keyspaceSubscriber.cancel()
+	for _, pubsub := range rs.keyspaceSubscriber.pubsubs {
+		pubsub.Close()
+	}
+	<-rs.keyspaceSubscriber.done
+	rs.keyspaceSubscriber = nil
+}
+
+// checkKeyspaceEventsConfig logs a warning if the Redis server is not configured to publish
+// the keyspace notifications required by the subscriber.
+func (rs *RedisStorage) checkKeyspaceEventsConfig(ctx context.Context, client *redis.Client) {
+	config, err := client.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil || rs.logger == nil {
+		// CONFIG is often disabled by managed Redis services
+		return
+	}
+	events := config["notify-keyspace-events"]
+	for _, class := range requiredKeyspaceEvents {
+		if !strings.ContainsRune(events, class) && (class == 'K' || !strings.ContainsRune(events, 'A')) {
+			rs.logger.Warnf("Redis server %s is not configured to publish required keyspace notifications: notify-keyspace-events is %q, expected %q", client.Options().Addr, events, requiredKeyspaceEvents)
+			return
+		}
+	}
+}
+
+func (rs *RedisStorage) receiveKeyspaceNotifications(ctx context.Context, pubsub *redis.PubSub) {
+	channelPrefix := rs.keyspaceChannelPrefix()
+	for msg := range pubsub.Channel() {
+		redisKey := strings.TrimPrefix(msg.Channel, channelPrefix)
+		if err := rs.handleKeyspaceNotification(ctx, redisKey, msg.Payload); err != nil && rs.logger != nil {
+			rs.logger.Warnw("Unable to handle keyspace notification", "key", redisKey, "event", msg.Payload, "error", err)
+		}
+	}
+}
+
+// handleKeyspaceNotification removes redisKey from the directory index, pruning empty parent
+// directories, after the key has expired or been evicted or deleted.
+func (rs *RedisStorage) handleKeyspaceNotification(ctx context.Context, redisKey, event string) error {
+
+	switch event {
+	case "expired", "evicted", "del":
+	default:
+		return nil
+	}
+
+	// The key may have been stored again since the notification was published
+	_, err := rs.deleteAbsentDirectoryRecord(ctx, redisKey, false)
+	return err
+}
@@ -0,0 +1,168 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyspaceChannelPattern(t *testing.T) {
+	t.Parallel()
+
+	rs := New()
+	rs.DB = "3"
+	rs.KeyPrefix = "caddy"
+	assert.Equal(t, "__keyspace@3__:caddy/*", rs.keyspaceChannelPattern())
+
+	rs.KeyPrefix = "tenant[1]/caddy*"
+	assert.Equal(t, `__keyspace@3__:tenant\[1\]/caddy\*/*`, rs.keyspaceChannelPattern())
+}
+
+func TestRedisStorage_HandleKeyspaceNotification(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	require.NoError(t, err)
+	err = rs.Store(ctx, TestKeyExampleKey, TestValueKey)
+	require.NoError(t, err)
+
+	// Notifications of keys that still exist are ignored
+	err = rs.handleKeyspaceNotification(ctx, rs.prefixKey(TestKeyExampleCrt), "del")
+	require.NoError(t, err)
+	keys, err := rs.List(ctx, TestKeyExamplePath, false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{TestKeyExampleCrt, TestKeyExampleKey}, keys)
+
+	// Simulate eviction of the certificate key
+	err = rs.client.Del(ctx, rs.prefixKey(TestKeyExampleCrt)).Err()
+	require.NoError(t, err)
+
+	// Unrelated events are ignored
+	err = rs.handleKeyspaceNotification(ctx, rs.prefixKey(TestKeyExampleCrt), "set")
+	require.NoError(t, err)
+	keys, err = rs.List(ctx, TestKeyExamplePath, false)
+	require.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	err = rs.handleKeyspaceNotification(ctx, rs.prefixKey(TestKeyExampleCrt), "evicted")
+	require.NoError(t, err)
+	keys, err = rs.List(ctx, TestKeyExamplePath, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{TestKeyExampleKey}, keys)
+
+	// Removing the last key prunes empty parent directories
+	err = rs.client.Del(ctx, rs.prefixKey(TestKeyExampleKey)).Err()
+	require.NoError(t, err)
+	err = rs.handleKeyspaceNotification(ctx, rs.prefixKey(TestKeyExampleKey), "expired")
+	require.NoError(t, err)
+	keys, err = rs.List(ctx, "", true)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	assert.False(t, rs.Exists(ctx, TestKeyCertPath))
+}
+
+func TestRedisStorage_HandleKeyspaceNotificationRestore(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+	rs.TTL = []KeyTTL{{Pattern: "ocsp/*", TTL: caddy.Duration(time.Hour)}}
+
+	key := "ocsp/example.com"
+	redisKey := rs.prefixKey(key)
+
+	err := rs.Store(ctx, key, TestValueKey)
+	require.NoError(t, err)
+	err = rs.client.Del(ctx, redisKey).Err()
+	require.NoError(t, err)
+
+	// The key is stored again while the expiry notification is handled: the handler runs after
+	// the directory records are created but before the value is written
+	sd, err := rs.encodeStorageData(key, TestValueCrt)
+	require.NoError(t, err)
+	score := float64(sd.Modified.Unix())
+	err = rs.storeDirectoryRecord(ctx, redisKey, score, false)
+	require.NoError(t, err)
+
+	err = rs.handleKeyspaceNotification(ctx, redisKey, "expired")
+	require.NoError(t, err)
+
+	_, err = rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		rs.queueDirectoryRecords(ctx, pipe, redisKey, score)
+		return rs.queueStorageData(ctx, pipe, redisKey, sd, time.Hour)
+	})
+	require.NoError(t, err)
+	err = rs.recordExpiry(ctx, redisKey, time.Hour)
+	require.NoError(t, err)
+
+	keys, err := rs.List(ctx, "", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+
+	// Notifications handled once the key was stored again leave the index untouched
+	err = rs.handleKeyspaceNotification(ctx, redisKey, "expired")
+	require.NoError(t, err)
+	keys, err = rs.List(ctx, "", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+	assert.Equal(t, []string{redisKey}, rs.client.ZRange(ctx, rs.expiryIndexKey(), 0, -1).Val())
+
+	pruned, err := rs.pruneExpiredKeys(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, pruned)
+
+	// Records are removed once the key no longer exists
+	err = rs.client.Del(ctx, redisKey).Err()
+	require.NoError(t, err)
+	err = rs.handleKeyspaceNotification(ctx, redisKey, "expired")
+	require.NoError(t, err)
+	keys, err = rs.List(ctx, "", true)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	assert.Zero(t, rs.client.Exists(ctx, rs.prefixKey("ocsp"), rs.expiryIndexKey()).Val())
+}
+
+func TestRedisStorage_KeyspaceNotifications(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	err := rs.startKeyspaceNotifications()
+	require.NoError(t, err)
+	defer rs.stopKeyspaceNotifications()
+
+	err = rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	require.NoError(t, err)
+	err = rs.Store(ctx, TestKeyExampleKey, TestValueKey)
+	require.NoError(t, err)
+
+	// Simulate the notification published by Redis when the key expires
+	err = rs.client.Del(ctx, rs.prefixKey(TestKeyExampleCrt)).Err()
+	require.NoError(t, err)
+	err = rs.client.Publish(ctx, rs.keyspaceChannelPrefix()+rs.prefixKey(TestKeyExampleCrt), "expired").Err()
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		keys, err := rs.List(ctx, TestKeyExamplePath, false)
+		return err == nil && len(keys) == 1 && keys[0] == TestKeyExampleKey
+	}, 5*time.Second, 10*time.Millisecond)
+
+	rs.stopKeyspaceNotifications()
+	assert.Nil(t, rs.keyspaceSubscriber)
+}
@@ -0,0 +1,718 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// Default number of keys scanned and processed per pipelined batch during repair
+	defaultRepairBatchSize = 500
+
+	// Default number of batches and directories processed concurrently during repair
+	defaultRepairConcurrency = 4
+)
+
+// RepairOptions controls optional behaviour of RepairWithOptions.
+type RepairOptions struct {
+	// VerifyChecksums decodes every stored value and reports values that fail checksum
+	// verification or cannot be decoded. Reported values are not modified.
+	VerifyChecksums bool
+	// DryRun reports the problems found without modifying the directory index.
+	DryRun bool
+	// Quarantine renames keys that cannot be read or have an unexpected Redis type to
+	// "<key_prefix>:quarantine/<key>", removing them from the storage key space.
+	Quarantine bool
+	// BatchSize Number of keys scanned and processed per pipelined batch. Default: 500
+	BatchSize int
+	// Concurrency Number of batches of scanned keys processed concurrently on each master
+	// node, and number of directories traversed concurrently. Default: 4
+	Concurrency int
+}
+
+// RepairReport describes the problems found by RepairWithOptions. Unless the repair was a dry
+// run, index problems have been fixed. Keys and directories are Redis key names.
+type RepairReport struct {
+	DryRun bool `json:"dry_run"`
+	// MissingEntries Index records missing for stored keys and their parent directories
+	MissingEntries []RepairIndexEntry `json:"missing_entries"`
+	// StaleEntries Index records referring to keys that do not exist or have the wrong type
+	StaleEntries []RepairIndexEntry `json:"stale_entries"`
+	// OrphanedDirectories Directory sets containing only stale index records, or that are not
+	// referenced by their parent directory and contain no valid index records
+	OrphanedDirectories []string `json:"orphaned_directories"`
+	// UnreadableValues Stored values that could not be loaded or decoded
+	UnreadableValues []RepairKeyError `json:"unreadable_values"`
+	// UnexpectedTypes Keys below the key prefix with a Redis type not used by this module
+	UnexpectedTypes []RepairKeyType `json:"unexpected_types"`
+	// Quarantined Unreadable keys and keys with unexpected types that were renamed
+	Quarantined []RepairQuarantinedKey `json:"quarantined"`
+
+	missing map[RepairIndexEntry]struct{}
+}
+
+// RepairIndexEntry identifies a record of the directory index.
+type RepairIndexEntry struct {
+	Directory string `json:"directory"`
+	Entry     string `json:"entry"`
+}
+
+// RepairKeyError describes a key that could not be processed.
+type RepairKeyError struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// RepairKeyType describes a key having an unexpected Redis type.
+type RepairKeyType struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+}
+
+// RepairQuarantinedKey describes a key renamed by quarantining.
+type RepairQuarantinedKey struct {
+	Key           string `json:"key"`
+	QuarantineKey string `json:"quarantine_key"`
+}
+
+func newRepairReport(dryRun bool) *RepairReport {
+	return &RepairReport{
+		DryRun:              dryRun,
+		MissingEntries:      []RepairIndexEntry{},
+		StaleEntries:        []RepairIndexEntry{},
+		OrphanedDirectories: []string{},
+		UnreadableValues:    []RepairKeyError{},
+		UnexpectedTypes:     []RepairKeyType{},
+		Quarantined:         []RepairQuarantinedKey{},
+		missing:             map[RepairIndexEntry]struct{}{},
+	}
+}
+
+// Repair rebuilds the directory index tree below dir, see RepairWithOptions.
+func (rs *RedisStorage) Repair(ctx context.Context, dir string) error {
+	_, err := rs.RepairWithOptions(ctx, dir, RepairOptions{})
+	return err
+}
+
+// RepairWithOptions rebuilds the directory index tree below dir. When called for the root
+// directory, all stored keys are scanned on every master node and missing index records are
+// added. Index records referring to non-existent keys are removed. The returned report
+// describes the problems found, and is returned along with any error for the problems found
+// until then.
+func (rs *RedisStorage) RepairWithOptions(ctx context.Context, dir string, opts RepairOptions) (*RepairReport, error) {
+
+	run := newRepairRun(rs, opts)
+
+	// Perform recursive full key scan only from the root directory
+	if dir == "" {
+		if err := run.scan(ctx); err != nil {
+			return run.report, err
+		}
+	}
+
+	_, err := run.repairDirectory(ctx, dir)
+	return run.report, err
+}
+
+// repairRun holds the state of a single repair, which is shared by concurrent workers.
+type repairRun struct {
+	rs   *RedisStorage
+	opts RepairOptions
+
+	// Incremental repairs check the records of every scanned directory set
+	// instead of traversing the directory tree
+	incremental bool
+
+	mu     sync.Mutex
+	report *RepairReport
+
+	// Limits the number of directories traversed concurrently
+	slots chan struct{}
+}
+
+// newRepairRun returns the state of a new repair, applying option defaults.
+func newRepairRun(rs *RedisStorage, opts RepairOptions) *repairRun {
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultRepairBatchSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultRepairConcurrency
+	}
+
+	return &repairRun{
+		rs:     rs,
+		opts:   opts,
+		report: newRepairReport(opts.DryRun),
+		slots:  make(chan struct{}, opts.Concurrency),
+	}
+}
+
+// record updates the report while holding the report lock.
+func (run *repairRun) record(update func(report *RepairReport)) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	update(run.report)
+}
+
+// scan scans the keys stored on every master node, adding missing index records.
+func (run *repairRun) scan(ctx context.Context) error {
+	pattern := run.rs.storageKeyPattern()
+	return run.rs.forEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+		return run.scanNode(ctx, client, pattern)
+	})
+}
+
+// scanNode scans the keys stored on a single node, processing up to Concurrency batches
+// of scanned keys concurrently.
+func (run *repairRun) scanNode(ctx context.Context, client *redis.Client, pattern string) error {
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(run.opts.Concurrency)
+
+	var pointer uint64 = 0
+	for {
+		// Scan for keys matching the search query and iterate until all found
+		keys, nextPointer, err := client.Scan(groupCtx, pointer, pattern, int64(run.opts.BatchSize)).Result()
+		if err != nil {
+			// Report the error of a failed batch that cancelled the scan
+			if groupErr := group.Wait(); groupErr != nil {
+				return groupErr
+			}
+			return fmt.Errorf("Unable to scan path %s: %v", pattern, err)
+		}
+
+		if len(keys) > 0 {
+			group.Go(func() error {
+				return run.repairKeys(groupCtx, keys)
+			})
+		}
+
+		// End of results reached
+		if nextPointer == 0 {
+			return group.Wait()
+		}
+		pointer = nextPointer
+	}
+}
+
+// repairKeys checks a batch of scanned keys according to their Redis type.
+func (run *repairRun) repairKeys(ctx context.Context, keys []string) error {
+
+	var rs = run.rs
+	var lockPrefix = rs.prefixLock("") + keyPathSeparator
+
+	// Skip keys used internally by this module
+	keys = slices.DeleteFunc(keys, func(key string) bool {
+		return rs.isInternalKey(key) || strings.HasPrefix(key, lockPrefix)
+	})
+
+	typeCmds := make([]*redis.StatusCmd, len(keys))
+	_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			typeCmds[i] = pipe.Type(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to get type of scanned keys: %v", err)
+	}
+
+	var values, valueTypes, sets []string
+	for i, key := range keys {
+		switch keyType := typeCmds[i].Val(); keyType {
+		case "string", "hash":
+			values = append(values, key)
+			valueTypes = append(valueTypes, keyType)
+		case "zset":
+			sets = append(sets, key)
+		case "none":
+			// Key deleted since the scan
+		default:
+			run.record(func(report *RepairReport) {
+				report.UnexpectedTypes = append(report.UnexpectedTypes, RepairKeyType{Key: key, Type: keyType})
+			})
+			if rs.logger != nil {
+				rs.logger.Infof("Key '%s' has unexpected type '%s'", key, keyType)
+			}
+			if err := run.quarantine(ctx, key); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := run.repairValues(ctx, values, valueTypes); err != nil {
+		return err
+	}
+
+	if run.incremental {
+		if err := run.repairScannedSets(ctx, sets); err != nil {
+			return err
+		}
+	}
+
+	return run.repairDirectorySets(ctx, sets)
+}
+
+// repairScannedSets removes the stale records of a batch of scanned directory sets.
+func (run *repairRun) repairScannedSets(ctx context.Context, keys []string) error {
+
+	var rs = run.rs
+
+	for _, key := range keys {
+		dirPath, err := rs.decodeKeyPath(rs.trimKey(key))
+		if err != nil {
+			// Directory sets with invalid names cannot be referenced by valid records
+			continue
+		}
+		if _, err := run.repairDirectory(ctx, dirPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// repairValues loads a batch of stored values, adding missing index records.
+func (run *repairRun) repairValues(ctx context.Context, keys, keyTypes []string) error {
+
+	var rs = run.rs
+
+	reads := make([]func() (*StorageData, error), len(keys))
+	_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			if keyTypes[i] == "hash" {
+				cmd := pipe.HGetAll(ctx, key)
+				reads[i] = func() (*StorageData, error) { return parseHashStorageData(cmd) }
+			} else {
+				cmd := pipe.Get(ctx, key)
+				reads[i] = func() (*StorageData, error) { return parseStringStorageData(cmd) }
+			}
+		}
+		return nil
+	})
+	// Errors replied for individual keys are handled below
+	var redisErr redis.Error
+	if err != nil && !errors.As(err, &redisErr) {
+		return fmt.Errorf("Unable to get data of scanned keys: %v", err)
+	}
+
+	records := make([]repairRecord, 0, len(keys))
+	for i, key := range keys {
+
+		// Load the Storage Data struct to obtain modified time
+		trimmedKey, err := rs.decodeKeyPath(rs.trimKey(key))
+		if err != nil {
+			if err := run.unreadable(ctx, key, err, fmt.Sprintf("Unable to decode key name '%s'", key)); err != nil {
+				return err
+			}
+			continue
+		}
+		sd, err := reads[i]()
+		if errors.Is(err, fs.ErrNotExist) {
+			// Key deleted since the scan
+			continue
+		} else if err != nil {
+			if err := run.unreadable(ctx, key, err, fmt.Sprintf("Unable to load storage data for key '%s'", trimmedKey)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Report values failing checksum verification
+		if run.opts.VerifyChecksums {
+			if _, err := rs.decodeStorageData(trimmedKey, sd); err != nil {
+				run.record(func(report *RepairReport) {
+					report.UnreadableValues = append(report.UnreadableValues, RepairKeyError{Key: key, Error: err.Error()})
+				})
+				if rs.logger != nil {
+					if errors.Is(err, ErrChecksumMismatch) {
+						rs.logger.Warnf("Checksum verification failed for key '%s'", trimmedKey)
+					} else {
+						rs.logger.Warnf("Unable to decode value for key '%s': %v", trimmedKey, err)
+					}
+				}
+			}
+		}
+
+		records = append(records, repairRecord{key: key, score: float64(sd.Modified.Unix())})
+	}
+
+	return run.repairDirectoryRecords(ctx, records)
+}
+
+// unreadable reports a key that could not be read, and quarantines it if requested.
+func (run *repairRun) unreadable(ctx context.Context, key string, err error, message string) error {
+	run.record(func(report *RepairReport) {
+		report.UnreadableValues = append(report.UnreadableValues, RepairKeyError{Key: key, Error: err.Error()})
+	})
+	if run.rs.logger != nil {
+		run.rs.logger.Info(message)
+	}
+	return run.quarantine(ctx, key)
+}
+
+// repairRecord is a key whose index records must exist, and the score of its record.
+type repairRecord struct {
+	key       string
+	score     float64
+	baseIsDir bool
+}
+
+// repairDirectoryRecords adds the index records of a batch of keys and all of their parent
+// directories if missing, recording them in the report.
+func (run *repairRun) repairDirectoryRecords(ctx context.Context, records []repairRecord) error {
+
+	var rs = run.rs
+
+	// Collect the records of every key and parent directory once, directories
+	// using the most recent score of the keys they contain
+	var entries []RepairIndexEntry
+	var scores = map[RepairIndexEntry]float64{}
+	for _, record := range records {
+		key, baseIsDir := record.key, record.baseIsDir
+		for {
+			// Extract parent directory and base (file) names from key
+			dir, base := rs.splitDirectoryKey(key, baseIsDir)
+			// Reached the top-level directory
+			if dir == "." {
+				break
+			}
+			entry := RepairIndexEntry{Directory: dir, Entry: base}
+			if score, ok := scores[entry]; !ok {
+				entries = append(entries, entry)
+				scores[entry] = record.score
+			} else if record.score > score {
+				scores[entry] = record.score
+			}
+			key, baseIsDir = dir, true
+		}
+	}
+
+	// Insert missing records, or only check their existence in dry run mode
+	cmds := make([]redis.Cmder, len(entries))
+	_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, entry := range entries {
+			if run.opts.DryRun {
+				cmds[i] = pipe.ZScore(ctx, entry.Directory, entry.Entry)
+			} else {
+				cmds[i] = pipe.ZAdd(ctx, entry.Directory, redis.Z{Score: scores[entry], Member: entry.Entry})
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("Unable to repair directory index: %v", err)
+	}
+
+	for i, entry := range entries {
+		var missing bool
+		switch cmd := cmds[i].(type) {
+		case *redis.FloatCmd:
+			missing = errors.Is(cmd.Err(), redis.Nil)
+		case *redis.IntCmd:
+			missing = cmd.Val() > 0
+		}
+		if !missing {
+			continue
+		}
+
+		// Parent directories of keys in several batches are only reported once in dry run mode
+		var reported bool
+		run.record(func(report *RepairReport) {
+			if _, reported = report.missing[entry]; !reported {
+				report.missing[entry] = struct{}{}
+				report.MissingEntries = append(report.MissingEntries, entry)
+			}
+		})
+		if !reported && !run.opts.DryRun && rs.logger != nil {
+			rs.logger.Infof("Repaired index for record '%s' in directory '%s'", entry.Entry, entry.Directory)
+		}
+	}
+
+	return nil
+}
+
+// repairDirectorySets checks that a batch of directory sets are referenced by their parent
+// directories, see repairUnlinkedSet.
+func (run *repairRun) repairDirectorySets(ctx context.Context, keys []string) error {
+
+	var rs = run.rs
+
+	// The root directory has no parent
+	keys = slices.DeleteFunc(keys, func(key string) bool {
+		dir, _ := rs.splitDirectoryKey(key, true)
+		return dir == "." || key == rs.prefixKey("")
+	})
+
+	scoreCmds := make([]*redis.FloatCmd, len(keys))
+	_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			dir, base := rs.splitDirectoryKey(key, true)
+			scoreCmds[i] = pipe.ZScore(ctx, dir, base)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("Unable to check directory index: %v", err)
+	}
+
+	for i, key := range keys {
+		if errors.Is(scoreCmds[i].Err(), redis.Nil) {
+			if err := run.repairUnlinkedSet(ctx, key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// repairUnlinkedSet re-links a directory set that is not referenced by its parent directory if
+// it contains valid index records, otherwise it is reported as orphaned and removed.
+func (run *repairRun) repairUnlinkedSet(ctx context.Context, key string) error {
+
+	var rs = run.rs
+
+	dirPath, err := rs.decodeKeyPath(rs.trimKey(key))
+	if err != nil {
+		run.record(func(report *RepairReport) {
+			report.UnreadableValues = append(report.UnreadableValues, RepairKeyError{Key: key, Error: err.Error()})
+		})
+		if rs.logger != nil {
+			rs.logger.Infof("Unable to decode key name '%s'", key)
+		}
+		return nil
+	}
+
+	// Validate the records of the directory, removing it if none are valid
+	orphaned, err := run.repairDirectory(ctx, dirPath)
+	if err != nil {
+		return err
+	}
+	if orphaned {
+		run.record(func(report *RepairReport) {
+			report.OrphanedDirectories = append(report.OrphanedDirectories, key)
+		})
+		if !run.opts.DryRun && rs.logger != nil {
+			rs.logger.Infof("Removed orphaned directory '%s'", key)
+		}
+		return nil
+	}
+
+	// Re-link the directory using the most recent modified time of its records
+	latest, err := rs.client.ZRevRangeWithScores(ctx, key, 0, 0).Result()
+	if err != nil {
+		return fmt.Errorf("Unable to get range on sorted set '%s': %v", key, err)
+	}
+	if len(latest) == 0 {
+		return nil
+	}
+	return run.repairDirectoryRecords(ctx, []repairRecord{{key: key, score: latest[0].Score, baseIsDir: true}})
+}
+
+// quarantineKey returns the Redis key name that an unreadable key is renamed to by repair.
+func (rs *RedisStorage) quarantineKey(key string) string {
+	return rs.KeyPrefix + ":quarantine" + keyPathSeparator + rs.trimKey(key)
+}
+
+// quarantine moves an unreadable key out of the storage key space if quarantining is
+// enabled, removing its index record. Failures are logged and do not abort the repair.
+func (run *repairRun) quarantine(ctx context.Context, key string) error {
+
+	var rs = run.rs
+
+	if !run.opts.Quarantine {
+		return nil
+	}
+
+	quarantineKey := rs.quarantineKey(key)
+
+	if !run.opts.DryRun {
+		// Renaming fails in cluster mode unless both keys are stored in the same hash slot
+		if err := rs.client.Rename(ctx, key, quarantineKey).Err(); err != nil {
+			if rs.logger != nil {
+				rs.logger.Warnf("Unable to quarantine key '%s': %v", key, err)
+			}
+			return nil
+		}
+		if err := rs.deleteDirectoryRecord(ctx, key, false); err != nil {
+			return err
+		}
+		if rs.logger != nil {
+			rs.logger.Infof("Quarantined key '%s' as '%s'", key, quarantineKey)
+		}
+	}
+
+	run.record(func(report *RepairReport) {
+		report.Quarantined = append(report.Quarantined, RepairQuarantinedKey{Key: key, QuarantineKey: quarantineKey})
+	})
+	return nil
+}
+
+// deleteUnchangedRecordsScript removes members from the directory Sorted Set KEYS[1] given as
+// pairs of member and score in ARGV, only while the score of a member is unchanged. Returns
+// the removed members.
+var deleteUnchangedRecordsScript = redis.NewScript(`
+local removed = {}
+for i = 1, #ARGV, 2 do
+	local score = redis.call('ZSCORE', KEYS[1], ARGV[i])
+	if score and tonumber(score) == tonumber(ARGV[i + 1]) then
+		redis.call('ZREM', KEYS[1], ARGV[i])
+		removed[#removed + 1] = ARGV[i]
+	end
+end
+return removed
+`)
+
+// repairDirectory removes index records below dir referring to non-existent keys or keys of
+// the wrong type, recording them in the report. The records are checked in pipelined batches
+// and subdirectories are traversed concurrently. Returns true if no valid records remain in dir.
+func (run *repairRun) repairDirectory(ctx context.Context, dir string) (bool, error) {
+
+	var rs = run.rs
+	var currKey = rs.prefixKey(dir)
+	var batchSize = int64(run.opts.BatchSize)
+
+	// Records to remove after all records have been checked, so that the
+	// ranges of records obtained in batches are not shifted by removals
+	var mu sync.Mutex
+	var removals []redis.Z
+	var total int
+
+	group, groupCtx := errgroup.WithContext(ctx)
+
+	for start := int64(0); ; start += batchSize {
+		// Obtain a batch of direct children stored in the Sorted Set
+		records, err := rs.client.ZRangeWithScores(ctx, currKey, start, start+batchSize-1).Result()
+		if err != nil {
+			_ = group.Wait()
+			return false, fmt.Errorf("Unable to get range on sorted set '%s': %v", currKey, err)
+		}
+		total += len(records)
+
+		childKeys := make([]string, len(records))
+		typeCmds := make([]*redis.StatusCmd, len(records))
+		for i, record := range records {
+			// Decrypt child key name if key name encryption enabled, directory keys will have a "/" suffix
+			childKey, err := rs.decodeKeyPath(strings.TrimSuffix(record.Member.(string), keyPathSeparator))
+			if err != nil {
+				_ = group.Wait()
+				return false, err
+			}
+			// Reconstruct the full path of child key
+			childKeys[i] = path.Join(dir, childKey)
+		}
+		_, err = rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i := range records {
+				typeCmds[i] = pipe.Type(ctx, rs.prefixKey(childKeys[i]))
+			}
+			return nil
+		})
+		if err != nil {
+			_ = group.Wait()
+			return false, fmt.Errorf("Unable to get type of keys in directory '%s': %v", currKey, err)
+		}
+
+		for i, record := range records {
+			// Records must refer to a directory set or a stored value respectively
+			k := record.Member.(string)
+			keyType := typeCmds[i].Val()
+			isDir := strings.HasSuffix(k, keyPathSeparator)
+			if isDir && keyType == "zset" && run.incremental {
+				// Checked when the directory set is scanned
+				continue
+			} else if isDir && keyType == "zset" {
+				childKey := childKeys[i]
+				traverse := func() error {
+					// Recursively traverse all child directories
+					orphaned, err := run.repairDirectory(groupCtx, childKey)
+					if err != nil || !orphaned {
+						return err
+					}
+					run.record(func(report *RepairReport) {
+						report.OrphanedDirectories = append(report.OrphanedDirectories, rs.prefixKey(childKey))
+					})
+					mu.Lock()
+					removals = append(removals, record)
+					mu.Unlock()
+					return nil
+				}
+				// Traverse concurrently while below the concurrency limit
+				select {
+				case run.slots <- struct{}{}:
+					group.Go(func() error {
+						defer func() { <-run.slots }()
+						return traverse()
+					})
+				default:
+					if err := traverse(); err != nil {
+						_ = group.Wait()
+						return false, err
+					}
+				}
+			} else if isDir || (keyType != "string" && keyType != "hash") {
+				run.record(func(report *RepairReport) {
+					report.StaleEntries = append(report.StaleEntries, RepairIndexEntry{Directory: currKey, Entry: k})
+				})
+				mu.Lock()
+				removals = append(removals, record)
+				mu.Unlock()
+			}
+		}
+
+		// End of the Sorted Set reached
+		if int64(len(records)) < batchSize {
+			break
+		}
+	}
+
+	if err := group.Wait(); err != nil {
+		return false, err
+	}
+
+	if run.opts.DryRun || len(removals) == 0 {
+		return total == len(removals), nil
+	}
+
+	// Remove keys from set if they are invalid or orphaned directories. Records updated since
+	// they were checked, such as records of keys being stored concurrently, are kept.
+	args := make([]any, 0, 2*len(removals))
+	for _, record := range removals {
+		args = append(args, record.Member, record.Score)
+	}
+	removed, err := deleteUnchangedRecordsScript.Run(ctx, rs.client, []string{currKey}, args...).StringSlice()
+	if err != nil {
+		return false, fmt.Errorf("Unable to remove stale records from directory '%s': %v", currKey, err)
+	}
+	if rs.logger != nil {
+		for _, k := range removed {
+			rs.logger.Infof("Removed stale record '%s' from directory '%s'", k, currKey)
+		}
+	}
+
+	return total == len(removed), nil
+}
@@ -0,0 +1,316 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisStorage_RepairReport(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	require.NoError(t, err)
+	err = rs.Store(ctx, TestKeyExampleKey, TestValueKey)
+	require.NoError(t, err)
+
+	examplePath := rs.prefixKey(TestKeyExamplePath)
+	acmePath := rs.prefixKey(TestKeyAcmePath)
+	orphanPath := rs.prefixKey(TestKeyAcmePath + "/orphan.com")
+
+	// Missing index record of a stored key
+	err = rs.client.ZRem(ctx, examplePath, "example.com.crt").Err()
+	require.NoError(t, err)
+	// Index record referring to a non-existent key
+	err = rs.client.ZAdd(ctx, examplePath, redis.Z{Score: 1, Member: "example.com.json"}).Err()
+	require.NoError(t, err)
+	// Directory containing only index records referring to non-existent keys
+	err = rs.client.ZAdd(ctx, acmePath, redis.Z{Score: 1, Member: "orphan.com/"}).Err()
+	require.NoError(t, err)
+	err = rs.client.ZAdd(ctx, orphanPath, redis.Z{Score: 1, Member: "orphan.com.crt"}).Err()
+	require.NoError(t, err)
+	// Value that cannot be decoded
+	err = rs.client.Set(ctx, rs.prefixKey(TestKeyCertPath+"/corrupt"), "corrupt", 0).Err()
+	require.NoError(t, err)
+	// Key with a type not used for stored values
+	err = rs.client.LPush(ctx, rs.prefixKey(TestKeyCertPath+"/list"), "item").Err()
+	require.NoError(t, err)
+	// Lock keys are ignored
+	err = rs.Lock(ctx, TestKeyLock)
+	require.NoError(t, err)
+	defer rs.Unlock(ctx, TestKeyLock)
+
+	assertReport := func(report *RepairReport) {
+		assert.Equal(t, []RepairIndexEntry{{Directory: examplePath, Entry: "example.com.crt"}}, report.MissingEntries)
+		assert.ElementsMatch(t, []RepairIndexEntry{{Directory: examplePath, Entry: "example.com.json"}, {Directory: orphanPath, Entry: "orphan.com.crt"}}, report.StaleEntries)
+		assert.Equal(t, []string{orphanPath}, report.OrphanedDirectories)
+		require.Len(t, report.UnreadableValues, 1)
+		assert.Equal(t, rs.prefixKey(TestKeyCertPath+"/corrupt"), report.UnreadableValues[0].Key)
+		assert.Equal(t, []RepairKeyType{{Key: rs.prefixKey(TestKeyCertPath + "/list"), Type: "list"}}, report.UnexpectedTypes)
+	}
+
+	// Dry run reports problems without modifying the index
+	for range 2 {
+		report, err := rs.RepairWithOptions(ctx, "", RepairOptions{DryRun: true})
+		require.NoError(t, err)
+		assert.True(t, report.DryRun)
+		assertReport(report)
+	}
+
+	report, err := rs.RepairWithOptions(ctx, "", RepairOptions{})
+	require.NoError(t, err)
+	assert.False(t, report.DryRun)
+	assertReport(report)
+
+	keys, err := rs.List(ctx, TestKeyAcmePath, true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{TestKeyExampleCrt, TestKeyExampleKey}, keys)
+	assert.False(t, rs.Exists(ctx, TestKeyAcmePath+"/orphan.com"))
+
+	// All index problems were fixed
+	report, err = rs.RepairWithOptions(ctx, "", RepairOptions{DryRun: true})
+	require.NoError(t, err)
+	assert.Empty(t, report.MissingEntries)
+	assert.Empty(t, report.StaleEntries)
+	assert.Empty(t, report.OrphanedDirectories)
+}
+
+func TestRedisStorage_RepairDirectorySets(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	require.NoError(t, err)
+	err = rs.Store(ctx, TestKeyExampleKey, TestValueKey)
+	require.NoError(t, err)
+
+	err = rs.Store(ctx, TestKeyAcmePath+"/other.com/other.com.crt", TestValueCrt)
+	require.NoError(t, err)
+
+	acmePath := rs.prefixKey(TestKeyAcmePath)
+	examplePath := rs.prefixKey(TestKeyExamplePath)
+	orphanPath := rs.prefixKey(TestKeyAcmePath + "/orphan.com")
+
+	// Directory set containing valid records not referenced by its parent
+	err = rs.client.ZRem(ctx, acmePath, "example.com/").Err()
+	require.NoError(t, err)
+	// Directory set containing only stale records not referenced by its parent
+	err = rs.client.ZAdd(ctx, orphanPath, redis.Z{Score: 1, Member: "orphan.com.crt"}).Err()
+	require.NoError(t, err)
+	// Directory record referring to a stored value
+	err = rs.client.ZAdd(ctx, examplePath, redis.Z{Score: 1, Member: "example.com.crt/"}).Err()
+	require.NoError(t, err)
+
+	report, err := rs.RepairWithOptions(ctx, "", RepairOptions{DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, []RepairIndexEntry{{Directory: acmePath, Entry: "example.com/"}}, report.MissingEntries)
+	assert.Equal(t, []string{orphanPath}, report.OrphanedDirectories)
+	assert.ElementsMatch(t, []RepairIndexEntry{{Directory: orphanPath, Entry: "orphan.com.crt"}, {Directory: examplePath, Entry: "example.com.crt/"}}, report.StaleEntries)
+
+	report, err = rs.RepairWithOptions(ctx, "", RepairOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []RepairIndexEntry{{Directory: acmePath, Entry: "example.com/"}}, report.MissingEntries)
+	assert.Equal(t, []string{orphanPath}, report.OrphanedDirectories)
+
+	assert.Zero(t, rs.client.Exists(ctx, orphanPath).Val())
+	keys, err := rs.List(ctx, "", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{TestKeyExampleCrt, TestKeyExampleKey, TestKeyAcmePath + "/other.com/other.com.crt"}, keys)
+
+	report, err = rs.RepairWithOptions(ctx, "", RepairOptions{DryRun: true})
+	require.NoError(t, err)
+	assert.Empty(t, report.MissingEntries)
+	assert.Empty(t, report.StaleEntries)
+	assert.Empty(t, report.OrphanedDirectories)
+}
+
+func TestRedisStorage_RepairQuarantine(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	require.NoError(t, err)
+
+	corruptKey := rs.prefixKey(TestKeyExampleKey)
+	listKey := rs.prefixKey(TestKeyCertPath + "/list")
+
+	// Corrupted value referenced by the directory index
+	err = rs.Store(ctx, TestKeyExampleKey, TestValueKey)
+	require.NoError(t, err)
+	err = rs.client.Set(ctx, corruptKey, "corrupt", 0).Err()
+	require.NoError(t, err)
+	err = rs.client.LPush(ctx, listKey, "item").Err()
+	require.NoError(t, err)
+
+	// Keys are only quarantined when requested
+	report, err := rs.RepairWithOptions(ctx, "", RepairOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, report.Quarantined)
+
+	report, err = rs.RepairWithOptions(ctx, "", RepairOptions{Quarantine: true, DryRun: true})
+	require.NoError(t, err)
+	assert.Len(t, report.Quarantined, 2)
+	assert.Equal(t, int64(2), rs.client.Exists(ctx, corruptKey, listKey).Val())
+
+	report, err = rs.RepairWithOptions(ctx, "", RepairOptions{Quarantine: true})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []RepairQuarantinedKey{
+		{Key: corruptKey, QuarantineKey: TestKeyPrefix + ":quarantine/" + TestKeyExampleKey},
+		{Key: listKey, QuarantineKey: TestKeyPrefix + ":quarantine/" + TestKeyCertPath + "/list"},
+	}, report.Quarantined)
+
+	assert.Zero(t, rs.client.Exists(ctx, corruptKey, listKey).Val())
+	assert.Equal(t, "corrupt", rs.client.Get(ctx, TestKeyPrefix+":quarantine/"+TestKeyExampleKey).Val())
+
+	keys, err := rs.List(ctx, "", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{TestKeyExampleCrt}, keys)
+
+	// Quarantined keys are not scanned again
+	report, err = rs.RepairWithOptions(ctx, "", RepairOptions{Quarantine: true})
+	require.NoError(t, err)
+	assert.Empty(t, report.UnreadableValues)
+	assert.Empty(t, report.UnexpectedTypes)
+	assert.Empty(t, report.Quarantined)
+}
+
+func TestRedisStorage_RepairForeignKeys(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	require.NoError(t, err)
+
+	// Keys of other applications sharing the key prefix
+	sessionKey := TestKeyPrefix + "-sessions:abc"
+	queueKey := TestKeyPrefix + "-queue"
+	err = rs.client.Set(ctx, sessionKey, "session", 0).Err()
+	require.NoError(t, err)
+	err = rs.client.LPush(ctx, queueKey, "item").Err()
+	require.NoError(t, err)
+
+	report, err := rs.RepairWithOptions(ctx, "", RepairOptions{Quarantine: true})
+	require.NoError(t, err)
+	assert.Empty(t, report.UnreadableValues)
+	assert.Empty(t, report.UnexpectedTypes)
+	assert.Empty(t, report.Quarantined)
+
+	assert.Equal(t, "session", rs.client.Get(ctx, sessionKey).Val())
+	assert.Equal(t, []string{"item"}, rs.client.LRange(ctx, queueKey, 0, -1).Val())
+}
+
+func TestRedisStorage_RepairBatches(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	var stored []string
+	for i := range 25 {
+		key := fmt.Sprintf("%s/domain%02d.com/domain%02d.com.crt", TestKeyAcmePath, i, i)
+		err := rs.Store(ctx, key, TestValueCrt)
+		require.NoError(t, err)
+		stored = append(stored, key)
+	}
+
+	// Replace the records of all domains with stale records
+	err := rs.client.Del(ctx, rs.prefixKey(TestKeyAcmePath)).Err()
+	require.NoError(t, err)
+	for i := range 10 {
+		err := rs.client.ZAdd(ctx, rs.prefixKey(TestKeyAcmePath), redis.Z{Score: 1, Member: fmt.Sprintf("stale%02d.com/", i)}).Err()
+		require.NoError(t, err)
+	}
+
+	opts := RepairOptions{BatchSize: 2, Concurrency: 3}
+
+	report, err := rs.RepairWithOptions(ctx, "", RepairOptions{BatchSize: 2, Concurrency: 3, DryRun: true})
+	require.NoError(t, err)
+	assert.Len(t, report.MissingEntries, 25)
+	assert.Len(t, report.StaleEntries, 10)
+
+	report, err = rs.RepairWithOptions(ctx, "", opts)
+	require.NoError(t, err)
+	assert.Len(t, report.MissingEntries, 25)
+	assert.Len(t, report.StaleEntries, 10)
+
+	keys, err := rs.List(ctx, "", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, stored, keys)
+
+	report, err = rs.RepairWithOptions(ctx, "", opts)
+	require.NoError(t, err)
+	assert.Empty(t, report.MissingEntries)
+	assert.Empty(t, report.StaleEntries)
+}
+
+// storeBeforeRemovalHook stores a key before the client first removes records from a Sorted Set,
+// either directly or using a script.
+type storeBeforeRemovalHook struct {
+	rs     *RedisStorage
+	key    string
+	value  []byte
+	stored bool
+}
+
+func (h *storeBeforeRemovalHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *storeBeforeRemovalHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !h.stored && slices.Contains([]string{"zrem", "eval", "evalsha"}, cmd.Name()) {
+			h.stored = true
+			if err := h.rs.Store(ctx, h.key, h.value); err != nil {
+				return err
+			}
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h *storeBeforeRemovalHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestRedisStorage_RepairConcurrentStore(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	require.NoError(t, err)
+
+	// Stale record of a deleted key
+	err = rs.client.Del(ctx, rs.prefixKey(TestKeyExampleCrt)).Err()
+	require.NoError(t, err)
+	err = rs.client.ZAdd(ctx, rs.prefixKey(TestKeyExamplePath), redis.Z{Score: 1, Member: "example.com.crt"}).Err()
+	require.NoError(t, err)
+
+	// The key is stored again after its record was checked but before stale records are removed
+	rs.client.AddHook(&storeBeforeRemovalHook{rs: rs, key: TestKeyExampleCrt, value: TestValueCrt})
+
+	report, err := rs.RepairWithOptions(ctx, "", RepairOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []RepairIndexEntry{{Directory: rs.prefixKey(TestKeyExamplePath), Entry: "example.com.crt"}}, report.StaleEntries)
+
+	keys, err := rs.List(ctx, "", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{TestKeyExampleCrt}, keys)
+}
@@ -15,7 +15,10 @@
 package storageredis
 
 import (
+	"bytes"
 	"context"
+	"crypto/cipher"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -24,12 +27,14 @@ import (
 	"io/fs"
 	"os"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/bsm/redislock"
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/certmagic"
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
@@ -54,6 +59,9 @@ const (
 	// Separator for Redis key path segments
 	keyPathSeparator = "/"
 
+	// Number of keys removed per transaction when deleting a directory
+	deleteBatchSize = 500
+
 	// Connect to Redis via TLS
 	defaultTLS = false
 
@@ -100,10 +108,52 @@ type RedisStorage struct {
 	// EncryptionKey A key string used to symmetrically encrypt and decrypt data stored in Redis.
 	// The key must be exactly 32 characters, longer values will be truncated. Default: "" (No encryption)
 	EncryptionKey string `json:"encryption_key"`
+	// EncryptionAlgorithm Specifies the cipher used when encrypting values stored in Redis.
+	// Valid values are "aes-gcm" or "xchacha20-poly1305". Default: "aes-gcm"
+	// Supports Caddy placeholders (e.g. {env.ENCRYPTION_ALGORITHM}).
+	EncryptionAlgorithm EncryptionAlgorithm `json:"encryption_algorithm"`
+	// EncryptKeyNames Deterministically encrypts every path segment of the Redis key names so that
+	// stored domain names are not revealed by the Redis keyspace. Requires EncryptionKey. Default: false
+	EncryptKeyNames bool `json:"encrypt_key_names"`
 	// Compression Specifies the compression algorithm to use when storing values in Redis.
-	// Valid values are "flate", "zlib", or "false" (no compression). Default: "" (no compression)
+	// Valid values are "flate", "zlib", "zstd", or "false" (no compression). Default: "" (no compression)
 	// Supports Caddy placeholders (e.g. {env.COMPRESSION}).
 	Compression CompressionMode `json:"compression"`
+	// CompressionLevel The compression level passed to the compression algorithm.
+	// Valid values are -2 to 9 for "flate" and "zlib", or 1 to 22 for "zstd".
+	// Default: "" (the algorithm's default level). Supports Caddy placeholders.
+	CompressionLevel string `json:"compression_level"`
+	// CompressionDictionary Path to a trained zstd dictionary file used to improve the
+	// compression ratio of small values. Only used by "zstd" compression. Default: "" (no dictionary)
+	CompressionDictionary string `json:"compression_dictionary"`
+	// CompressionMinSize Values smaller than this number of bytes are stored without compression.
+	// Default: "" (compress values of any size). Supports Caddy placeholders.
+	CompressionMinSize string `json:"compression_min_size"`
+	// MaxValueSize The maximum size in bytes of a value that may be stored or decompressed.
+	// Default: "" (4 MiB). Supports Caddy placeholders.
+	MaxValueSize string `json:"max_value_size"`
+	// ListPageSize The number of directory index records fetched per page by ListIter. Default: 1000
+	ListPageSize string `json:"list_page_size"`
+	// ValueFormat Specifies the format used to encode values stored in Redis.
+	// Valid values are "binary" (compact binary envelope) or "json" (legacy format). Default: "binary"
+	// Both formats are always readable. Supports Caddy placeholders.
+	ValueFormat ValueFormat `json:"value_format"`
+	// StorageLayout Specifies how values are stored in Redis. Valid values are "string" (each value is
+	// a single encoded string) or "hash" (each value is a hash with separate metadata fields, allowing
+	// Stat to skip transferring the value). Both layouts are always readable. Default: "string"
+	// Supports Caddy placeholders.
+	StorageLayout StorageLayout `json:"storage_layout"`
+	// TTL Time-to-live applied to stored keys matching a path pattern. The first matching pattern
+	// applies; keys not matching any pattern never expire. Expired keys are removed from the
+	// directory index as subsequent values are stored. Default: [] (keys never expire)
+	TTL []KeyTTL `json:"ttl,omitempty"`
+	// KeyspaceNotifications Subscribe to Redis keyspace notifications to remove keys that expire
+	// or are evicted or deleted from the directory index. Requires the Redis server option
+	// notify-keyspace-events to include "Kgxe". Default: false
+	KeyspaceNotifications bool `json:"keyspace_notifications"`
+	// RepairInterval Periodically repair the directory index in the background. Only one node
+	// sharing the same key prefix repairs the index per interval. Default: 0 (disabled)
+	RepairInterval caddy.Duration `json:"repair_interval,omitempty"`
 	// TlsEnabled controls whether TLS will be used to connect to the Redis
 	// server. False by default.
 	TlsEnabled bool `json:"tls_enabled"`
@@ -134,6 +184,14 @@ type RedisStorage struct {
 	locker *redislock.Client
 	logger *zap.SugaredLogger
 	locks  *sync.Map
+
+	keyNameCipher   cipher.AEAD
+	keyNameNonceKey []byte
+
+	compressionDictionary []byte
+
+	keyspaceSubscriber *keyspaceSubscriber
+	backgroundRepair   *backgroundRepair
 }
 
 // CompressionMode specifies the compression algorithm used when storing values.
@@ -145,10 +203,11 @@ const (
 	CompressionNone  CompressionMode = ""
 	CompressionFlate CompressionMode = "flate"
 	CompressionZlib  CompressionMode = "zlib"
+	CompressionZstd  CompressionMode = "zstd"
 )
 
 // UnmarshalJSON accepts both the legacy boolean form used before v1.7.1
-// ("compression": true/false) and the new string form ("compression": "flate"/"zlib"/"false"),
+// ("compression": true/false) and the new string form ("compression": "flate"/"zlib"/"zstd"/"false"),
 // preserving backwards compatibility with existing JSON configurations.
 func (c *CompressionMode) UnmarshalJSON(data []byte) error {
 	// Try bool first to handle legacy configs: true → "flate", false → ""
@@ -170,6 +229,31 @@ func (c *CompressionMode) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// EncryptionAlgorithm specifies the cipher used when encrypting values.
+// The algorithm is recorded per value so values encrypted with different ciphers can coexist.
+type EncryptionAlgorithm string
+
+const (
+	EncryptionAESGCM            EncryptionAlgorithm = "aes-gcm"
+	EncryptionXChaCha20Poly1305 EncryptionAlgorithm = "xchacha20-poly1305"
+)
+
+// ValueFormat specifies the encoding of StorageData values written to Redis.
+type ValueFormat string
+
+const (
+	ValueFormatBinary ValueFormat = "binary"
+	ValueFormatJSON   ValueFormat = "json"
+)
+
+// StorageLayout specifies the Redis data type used to store each value.
+type StorageLayout string
+
+const (
+	StorageLayoutString StorageLayout = "string"
+	StorageLayoutHash   StorageLayout = "hash"
+)
+
 // DBIndex holds a Redis database index. It accepts both integer (legacy JSON form)
 // and string (new JSON form) during unmarshalling, enabling runtime placeholder
 // substitution via Caddy's replacer (e.g. {env.REDIS_DB}).
@@ -203,6 +287,14 @@ const (
 	storageCompressionNone  = 0
 	storageCompressionFlate = 1
 	storageCompressionZlib  = 2
+	storageCompressionZstd  = 3
+)
+
+// StorageData encryption flag values stored per value in Redis.
+const (
+	storageEncryptionNone              = 0
+	storageEncryptionAESGCM            = 1
+	storageEncryptionXChaCha20Poly1305 = 2
 )
 
 type StorageData struct {
@@ -211,20 +303,29 @@ type StorageData struct {
 	Size        int64     `json:"size"`
 	Compression int       `json:"compression"`
 	Encryption  int       `json:"encryption"`
+	// Checksum SHA-256 of the original (uncompressed) value. Encrypted values and values
+	// stored by earlier versions have no checksum and are not verified.
+	Checksum []byte `json:"checksum,omitempty"`
 }
 
+// ErrChecksumMismatch is returned by Load when a stored value does not match its recorded checksum.
+var ErrChecksumMismatch = errors.New("checksum mismatch, stored value is corrupted")
+
 // create a new RedisStorage struct with default values
 func New() *RedisStorage {
 
 	rs := RedisStorage{
-		ClientType:  defaultClientType,
-		Host:        []string{defaultHost},
-		Port:        []string{defaultPort},
-		DB:          DBIndex(defaultDb),
-		KeyPrefix:   defaultKeyPrefix,
-		Compression: CompressionNone,
-		TlsEnabled:  defaultTLS,
-		TlsInsecure: defaultTLSInsecure,
+		ClientType:          defaultClientType,
+		Host:                []string{defaultHost},
+		Port:                []string{defaultPort},
+		DB:                  DBIndex(defaultDb),
+		KeyPrefix:           defaultKeyPrefix,
+		EncryptionAlgorithm: EncryptionAESGCM,
+		Compression:         CompressionNone,
+		ValueFormat:         ValueFormatBinary,
+		StorageLayout:       StorageLayoutString,
+		TlsEnabled:          defaultTLS,
+		TlsInsecure:         defaultTLSInsecure,
 	}
 	return &rs
 }
@@ -344,83 +445,162 @@ func (rs *RedisStorage) initRedisClient(ctx context.Context) error {
 	return nil
 }
 
+// forEachMaster calls fn for the standalone Redis server, or concurrently for every master
+// node when using the cluster or failover client types. Commands that only apply to a
+// single node, such as SCAN, must be issued using the client passed to fn. In failover
+// mode the master holds every key, so replicas are not visited.
+func (rs *RedisStorage) forEachMaster(ctx context.Context, fn func(ctx context.Context, client *redis.Client) error) error {
+	switch client := rs.client.(type) {
+	case *redis.ClusterClient:
+		return client.ForEachMaster(ctx, fn)
+	case *redis.Client:
+		return fn(ctx, client)
+	default:
+		return fmt.Errorf("Unsupported Redis client type %T", rs.client)
+	}
+}
+
 func (rs RedisStorage) Store(ctx context.Context, key string, value []byte) error {
 
+	sd, err := rs.encodeStorageData(key, value)
+	if err != nil {
+		return err
+	}
+
+	return rs.storeStorageData(ctx, key, sd)
+}
+
+// storeStorageData stores previously encoded data at key and records it in the directory index.
+func (rs RedisStorage) storeStorageData(ctx context.Context, key string, sd *StorageData) error {
+
+	var prefixedKey = rs.prefixKey(key)
+	var ttl = rs.keyTTL(key)
+
+	// Create directory structure set for current key
+	score := float64(sd.Modified.Unix())
+	if err := rs.storeDirectoryRecord(ctx, prefixedKey, score, false); err != nil {
+		return fmt.Errorf("Unable to create directory for key %s: %v", key, err)
+	}
+
+	// Store the key value in the Redis database
+	_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		rs.queueDirectoryRecords(ctx, pipe, prefixedKey, score)
+		return rs.queueStorageData(ctx, pipe, prefixedKey, sd, ttl)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to set value for %s: %v", key, err)
+	}
+
+	return rs.updateExpiryIndex(ctx, key, prefixedKey, ttl)
+}
+
+// queueDirectoryRecords queues the commands adding key and its missing parent directories to the
+// directory index, so that records removed after the key has expired are restored in the same
+// transaction as the value. Records are only removed once keys expire, so this is skipped unless
+// TTL patterns are configured, and when transactions cannot span hash slots.
+func (rs RedisStorage) queueDirectoryRecords(ctx context.Context, pipe redis.Pipeliner, key string, score float64) {
+
+	if len(rs.TTL) == 0 || !rs.supportsTransactions() {
+		return
+	}
+
+	dir, base := rs.splitDirectoryKey(key, false)
+	pipe.ZAdd(ctx, dir, redis.Z{Score: score, Member: base})
+	for dir, base = rs.splitDirectoryKey(dir, true); dir != "."; dir, base = rs.splitDirectoryKey(dir, true) {
+		pipe.ZAddNX(ctx, dir, redis.Z{Score: score, Member: base})
+	}
+}
+
+// updateExpiryIndex records the expiry of a stored key and removes previously expired keys from
+// the directory index. This is only performed when TTL patterns are configured.
+func (rs *RedisStorage) updateExpiryIndex(ctx context.Context, key, prefixedKey string, ttl time.Duration) error {
+
+	if len(rs.TTL) == 0 {
+		return nil
+	}
+
+	if err := rs.recordExpiry(ctx, prefixedKey, ttl); err != nil {
+		return fmt.Errorf("Unable to record expiry for key %s: %v", key, err)
+	}
+
+	// Failure to prune expired keys does not affect the stored value
+	if _, err := rs.pruneExpiredKeys(ctx); err != nil && rs.logger != nil {
+		rs.logger.Warnw("Unable to prune expired keys from directory index", "error", err)
+	}
+
+	return nil
+}
+
+// encodeStorageData compresses and encrypts value according to the configuration,
+// returning the StorageData to be stored with the current time as modified time.
+func (rs *RedisStorage) encodeStorageData(key string, value []byte) (*StorageData, error) {
+
 	var size = len(value)
+	var checksum []byte
 	var compressionFlag = storageCompressionNone
-	var encryptionFlag = 0
+	var encryptionFlag = storageEncryptionNone
+
+	// Reject values exceeding the configured size limit
+	if int64(size) > rs.maxValueSize() {
+		return nil, fmt.Errorf("Unable to store value for %s: size %d exceeds limit (%d bytes)", key, size, rs.maxValueSize())
+	}
 
-	// Compress value if compression enabled
-	if rs.Compression != CompressionNone {
+	// Compress value if compression enabled and value is large enough
+	if rs.Compression != CompressionNone && size >= rs.compressionMinSize() {
 		compressedValue, err := rs.compress(value)
 		if err != nil {
-			return fmt.Errorf("Unable to compress value for %s: %v", key, err)
+			return nil, fmt.Errorf("Unable to compress value for %s: %v", key, err)
 		}
 		// Check compression efficiency
 		if size > len(compressedValue) {
 			value = compressedValue
-			if rs.Compression == CompressionZlib {
-				compressionFlag = storageCompressionZlib
-			} else {
-				compressionFlag = storageCompressionFlate
-			}
+			compressionFlag = rs.compressionFlag()
 		}
 	}
 
-	// Encrypt value if encryption enabled
+	// Encrypt value if encryption enabled, the authentication tag of the cipher detects corrupted
+	// values. Otherwise record a checksum, which would reveal identical values if encrypted.
 	if rs.EncryptionKey != "" {
 		encryptedValue, err := rs.encrypt(value)
 		if err != nil {
-			return fmt.Errorf("Unable to encrypt value for %s: %v", key, err)
+			return nil, fmt.Errorf("Unable to encrypt value for %s: %v", key, err)
 		}
 		value = encryptedValue
-		encryptionFlag = 1
+		encryptionFlag = rs.encryptionFlag()
+	} else {
+		sum := sha256.Sum256(value)
+		checksum = sum[:]
 	}
 
-	sd := &StorageData{
+	return &StorageData{
 		Value:       value,
 		Modified:    time.Now(),
 		Size:        int64(size),
 		Compression: compressionFlag,
 		Encryption:  encryptionFlag,
-	}
-
-	jsonValue, err := json.Marshal(sd)
-	if err != nil {
-		return fmt.Errorf("Unable to marshal value for %s: %v", key, err)
-	}
-
-	var prefixedKey = rs.prefixKey(key)
+		Checksum:    checksum,
+	}, nil
+}
 
-	// Create directory structure set for current key
-	score := float64(sd.Modified.Unix())
-	if err := rs.storeDirectoryRecord(ctx, prefixedKey, score, false, false); err != nil {
-		return fmt.Errorf("Unable to create directory for key %s: %v", key, err)
-	}
+func (rs RedisStorage) Load(ctx context.Context, key string) ([]byte, error) {
 
-	// Store the key value in the Redis database
-	if err := rs.client.Set(ctx, prefixedKey, jsonValue, 0).Err(); err != nil {
-		return fmt.Errorf("Unable to set value for %s: %v", key, err)
+	sd, err := rs.loadStorageData(ctx, key)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return rs.decodeStorageData(key, sd)
 }
 
-func (rs RedisStorage) Load(ctx context.Context, key string) ([]byte, error) {
+// decodeStorageData decrypts and decompresses the value held by sd and verifies its checksum.
+func (rs *RedisStorage) decodeStorageData(key string, sd *StorageData) ([]byte, error) {
 
-	var sd *StorageData
-	var value []byte
+	var value = sd.Value
 	var err error
 
-	sd, err = rs.loadStorageData(ctx, key)
-	if err != nil {
-		return nil, err
-	}
-	value = sd.Value
-
 	// Decrypt value if encrypted
-	if sd.Encryption > 0 {
-		value, err = rs.decrypt(value)
+	if sd.Encryption > storageEncryptionNone {
+		value, err = rs.decrypt(value, sd.Encryption)
 		if err != nil {
 			return nil, fmt.Errorf("Unable to decrypt value for %s: %v", key, err)
 		}
@@ -434,13 +614,31 @@ func (rs RedisStorage) Load(ctx context.Context, key string) ([]byte, error) {
 		}
 	}
 
+	// Verify checksum if recorded, encrypted values were already authenticated by decryption
+	if len(sd.Checksum) > 0 {
+		checksum := sha256.Sum256(value)
+		if !bytes.Equal(checksum[:], sd.Checksum) {
+			return nil, fmt.Errorf("Unable to verify value for %s: %w", key, ErrChecksumMismatch)
+		}
+	}
+
 	return value, nil
 }
 
+// Delete removes the value stored at key. If key is a directory, all values and directories
+// below it are removed.
 func (rs RedisStorage) Delete(ctx context.Context, key string) error {
 
 	var prefixedKey = rs.prefixKey(key)
 
+	// Directories are stored as a Sorted Set of their children
+	keyType, err := rs.client.Type(ctx, prefixedKey).Result()
+	if err != nil {
+		return fmt.Errorf("Unable to get type of key %s: %v", key, err)
+	} else if keyType == "zset" {
+		return rs.deleteDirectory(ctx, key, prefixedKey)
+	}
+
 	// Remove current key from directory structure
 	if err := rs.deleteDirectoryRecord(ctx, prefixedKey, false); err != nil {
 		return fmt.Errorf("Unable to delete directory for key %s: %v", key, err)
@@ -450,11 +648,102 @@ func (rs RedisStorage) Delete(ctx context.Context, key string) error {
 		return fmt.Errorf("Unable to delete key %s: %v", key, err)
 	}
 
+	if len(rs.TTL) > 0 {
+		if err := rs.recordExpiry(ctx, prefixedKey, 0); err != nil {
+			return fmt.Errorf("Unable to remove expiry for key %s: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteDirectory removes all values and directory Sorted Sets below the directory prefixedKey,
+// then the directory itself. Keys are deleted in transactions of deleteBatchSize keys, or
+// pipelines in cluster mode; if interrupted, the remaining directory records are removed by the
+// repair command.
+func (rs RedisStorage) deleteDirectory(ctx context.Context, key, prefixedKey string) error {
+
+	values, dirs, err := rs.walkDirectory(ctx, prefixedKey)
+	if err != nil {
+		return fmt.Errorf("Unable to list directory %s: %v", key, err)
+	}
+
+	// Delete values first, then directories starting with the deepest
+	slices.Reverse(dirs)
+	redisKeys := append(values, dirs...)
+
+	// Transactions cannot span keys in different hash slots of a cluster
+	var pipelined = rs.client.TxPipelined
+	if !rs.supportsTransactions() {
+		pipelined = rs.client.Pipelined
+	}
+
+	for batch := range slices.Chunk(redisKeys, deleteBatchSize) {
+		_, err := pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, redisKey := range batch {
+				pipe.Del(ctx, redisKey)
+				if len(rs.TTL) > 0 {
+					pipe.ZRem(ctx, rs.expiryIndexKey(), redisKey)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to delete directory %s: %v", key, err)
+		}
+	}
+
+	// Remove the directory from its parent directory
+	if err := rs.deleteDirectoryRecord(ctx, prefixedKey, true); err != nil {
+		return fmt.Errorf("Unable to delete directory for key %s: %v", key, err)
+	}
+
 	return nil
 }
 
+// walkDirectory returns the value keys and directory Sorted Set keys below the directory
+// prefixedKey, including prefixedKey itself. Directories are returned in breadth-first order and
+// the Sorted Sets of each level of the tree are fetched in a single pipeline.
+func (rs RedisStorage) walkDirectory(ctx context.Context, prefixedKey string) ([]string, []string, error) {
+
+	var values []string
+	var dirs []string
+	var level = []string{prefixedKey}
+
+	for len(level) > 0 {
+		cmds := make([]*redis.StringSliceCmd, len(level))
+		_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, dir := range level {
+				cmds[i] = pipe.ZRange(ctx, dir, 0, -1)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		dirs = append(dirs, level...)
+		var nextLevel []string
+		for i, dir := range level {
+			for _, member := range cmds[i].Val() {
+				// Directory keys will have a "/" suffix
+				if trimmed, ok := strings.CutSuffix(member, keyPathSeparator); ok {
+					nextLevel = append(nextLevel, path.Join(dir, trimmed))
+				} else {
+					values = append(values, path.Join(dir, member))
+				}
+			}
+		}
+		level = nextLevel
+	}
+
+	return values, dirs, nil
+}
+
+// Exists reports whether a value or a directory is stored at key. Errors are logged and
+// reported as false; use ExistsWithError to distinguish absent keys from Redis failures.
 func (rs RedisStorage) Exists(ctx context.Context, key string) bool {
-	exists, err := rs.existsKey(ctx, key)
+	exists, err := rs.ExistsWithError(ctx, key)
 	if err != nil {
 		// CertMagic interface requires a boolean return only.
 		if rs.logger != nil {
@@ -465,13 +754,26 @@ func (rs RedisStorage) Exists(ctx context.Context, key string) bool {
 	return exists
 }
 
-func (rs RedisStorage) existsKey(ctx context.Context, key string) (bool, error) {
-	// Redis returns a count of the number of keys found
-	exists, err := rs.existsRawKey(ctx, rs.prefixKey(key))
+// ExistsWithError reports whether a value or a directory is stored at key, returning an error
+// if the existence could not be determined.
+func (rs RedisStorage) ExistsWithError(ctx context.Context, key string) (bool, error) {
+	var prefixedKey = rs.prefixKey(key)
+	keyType, err := rs.client.Type(ctx, prefixedKey).Result()
 	if err != nil {
 		return false, fmt.Errorf("Unable to check existence for %s: %v", key, err)
 	}
-	return exists, nil
+	switch keyType {
+	case "string", "hash":
+		// Values are stored using the "string" or "hash" layout
+		return true, nil
+	case "zset":
+		// Directories are stored as a Sorted Set of their children
+		return true, nil
+	case "none":
+		return false, nil
+	default:
+		return false, fmt.Errorf("Unexpected type %s for %s", keyType, key)
+	}
 }
 
 func (rs RedisStorage) existsRawKey(ctx context.Context, redisKey string) (bool, error) {
@@ -484,6 +786,11 @@ func (rs RedisStorage) existsRawKey(ctx context.Context, redisKey string) (bool,
 
 func (rs RedisStorage) List(ctx context.Context, dir string, recursive bool) ([]string, error) {
 
+	// Traverse all child directories server-side
+	if recursive {
+		return rs.listRecursive(ctx, dir)
+	}
+
 	var keyList []string
 	var currKey = rs.prefixKey(dir)
 
@@ -497,19 +804,13 @@ func (rs RedisStorage) List(ctx context.Context, dir string, recursive bool) ([]
 	for _, k := range keys {
 		// Directory keys will have a "/" suffix
 		trimmedKey := strings.TrimSuffix(k, keyPathSeparator)
-		// Reconstruct the full path of child key
-		fullPathKey := path.Join(dir, trimmedKey)
-		// If current key is a directory
-		if recursive && k != trimmedKey {
-			// Recursively traverse all child directories
-			childKeys, err := rs.List(ctx, fullPathKey, recursive)
-			if err != nil {
-				return keyList, err
-			}
-			keyList = append(keyList, childKeys...)
-		} else {
-			keyList = append(keyList, fullPathKey)
+		// Decrypt child key name if key name encryption enabled
+		childKey, err := rs.decodeKeyPath(trimmedKey)
+		if err != nil {
+			return keyList, err
 		}
+		// Reconstruct the full path of child key
+		keyList = append(keyList, path.Join(dir, childKey))
 	}
 
 	return keyList, nil
@@ -517,19 +818,46 @@ func (rs RedisStorage) List(ctx context.Context, dir string, recursive bool) ([]
 
 func (rs RedisStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
 
-	sd, err := rs.loadStorageData(ctx, key)
-	if err != nil {
+	var prefixedKey = rs.prefixKey(key)
+
+	modified, size, err := rs.statStorageData(ctx, prefixedKey)
+	if isWrongTypeError(err) {
+		// Directories are stored as a Sorted Set of their children
+		return rs.statDirectory(ctx, key, prefixedKey)
+	} else if errors.Is(err, fs.ErrNotExist) {
 		return certmagic.KeyInfo{}, err
+	} else if err != nil {
+		return certmagic.KeyInfo{}, fmt.Errorf("Unable to get data for %s: %v", key, err)
 	}
 
 	return certmagic.KeyInfo{
 		Key:        key,
-		Modified:   sd.Modified,
-		Size:       sd.Size,
+		Modified:   modified,
+		Size:       size,
 		IsTerminal: true,
 	}, nil
 }
 
+// statDirectory returns information about a directory, whose modification time is the most recent
+// score of its records. The record of a value holds the time it was last stored, while the record
+// of a subdirectory only holds the time a key was last created directly within the subdirectory:
+// overwriting existing keys or creating keys deeper in the tree does not update it.
+func (rs RedisStorage) statDirectory(ctx context.Context, key, prefixedKey string) (certmagic.KeyInfo, error) {
+
+	children, err := rs.client.ZRevRangeWithScores(ctx, prefixedKey, 0, 0).Result()
+	if err != nil {
+		return certmagic.KeyInfo{}, fmt.Errorf("Unable to get range on sorted set '%s': %v", prefixedKey, err)
+	} else if len(children) == 0 {
+		return certmagic.KeyInfo{}, fs.ErrNotExist
+	}
+
+	return certmagic.KeyInfo{
+		Key:        key,
+		Modified:   time.Unix(int64(children[0].Score), 0),
+		IsTerminal: false,
+	}, nil
+}
+
 func (rs *RedisStorage) Lock(ctx context.Context, name string) error {
 
 	key := rs.prefixLock(name)
@@ -540,35 +868,7 @@ func (rs *RedisStorage) Lock(ctx context.Context, name string) error {
 
 		// lock successfully obtained
 		if err == nil {
-			refreshCtx, cancel := context.WithCancel(context.Background())
-			// store lock handle + refresh cancel function for Unlock()
-			rs.locks.Store(key, heldLock{
-				lock:   lock,
-				cancel: cancel,
-			})
-			// keep the lock fresh until Unlock() cancels refreshCtx
-			go func(ctx context.Context, lock *redislock.Lock) {
-				ticker := time.NewTicker(lockRefreshInterval)
-				defer ticker.Stop()
-				for {
-					select {
-					case <-ticker.C:
-					case <-ctx.Done():
-						return
-					}
-
-					// refresh the Redis lock
-					err := lock.Refresh(ctx, lockTTL, nil)
-					if err == redislock.ErrNotObtained {
-						// lock was lost (expired or released externally), stop refreshing
-						return
-					}
-					if err != nil && rs.logger != nil {
-						rs.logger.Warnw("Failed to refresh lock, will retry", "key", key, "error", err)
-					}
-				}
-			}(refreshCtx, lock)
-
+			rs.holdLock(key, lock)
 			return nil
 		}
 
@@ -586,111 +886,71 @@ func (rs *RedisStorage) Lock(ctx context.Context, name string) error {
 	}
 }
 
-func (rs *RedisStorage) Unlock(ctx context.Context, name string) error {
+// TryLock obtains the named lock without waiting, returning false if the lock is held by
+// another caller. A lock obtained by TryLock is released by Unlock.
+func (rs *RedisStorage) TryLock(ctx context.Context, name string) (bool, error) {
 
 	key := rs.prefixLock(name)
 
-	// load and delete lock from sync.Map
-	if syncMapLock, loaded := rs.locks.LoadAndDelete(key); loaded {
-
-		// type assertion for held lock
-		if lock, ok := syncMapLock.(heldLock); ok {
-			lock.cancel()
-
-			// release the Redis lock
-			if err := lock.lock.Release(ctx); err != nil {
-				return fmt.Errorf("Unable to release lock for %s: %v", key, err)
-			}
-		}
+	lock, err := rs.locker.Obtain(ctx, key, lockTTL, &redislock.Options{})
+	if err == redislock.ErrNotObtained {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Unable to obtain lock for %s: %v", key, err)
 	}
 
-	return nil
+	rs.holdLock(key, lock)
+	return true, nil
 }
 
-func (rs *RedisStorage) Repair(ctx context.Context, dir string) error {
-
-	var currKey = rs.prefixKey(dir)
-
-	// Perform recursive full key scan only from the root directory
-	if dir == "" {
-
-		var pointer uint64 = 0
-		var scanCount int64 = 500
-
+// holdLock stores an obtained lock and keeps it fresh until released by Unlock.
+func (rs *RedisStorage) holdLock(key string, lock *redislock.Lock) {
+
+	refreshCtx, cancel := context.WithCancel(context.Background())
+	// store lock handle + refresh cancel function for Unlock()
+	rs.locks.Store(key, heldLock{
+		lock:   lock,
+		cancel: cancel,
+	})
+	// keep the lock fresh until Unlock() cancels refreshCtx
+	go func(ctx context.Context, lock *redislock.Lock) {
+		ticker := time.NewTicker(lockRefreshInterval)
+		defer ticker.Stop()
 		for {
-			// Scan for keys matching the search query and iterate until all found
-			keys, nextPointer, err := rs.client.Scan(ctx, pointer, currKey+"*", scanCount).Result()
-			if err != nil {
-				return fmt.Errorf("Unable to scan path %s: %v", currKey, err)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
 			}
 
-			// Iterate over returned keys
-			for _, key := range keys {
-				// Proceed only if key type is regular string value
-				keyType := rs.client.Type(ctx, key).Val()
-				if keyType != "string" {
-					continue
-				}
-
-				// Load the Storage Data struct to obtain modified time
-				trimmedKey := rs.trimKey(key)
-				sd, err := rs.loadStorageData(ctx, trimmedKey)
-				if err != nil {
-					if rs.logger != nil {
-						rs.logger.Infof("Unable to load storage data for key '%s'", trimmedKey)
-					}
-					continue
-				}
-
-				// Repair directory structure set for current key
-				score := float64(sd.Modified.Unix())
-				if err := rs.storeDirectoryRecord(ctx, key, score, true, false); err != nil {
-					return fmt.Errorf("Unable to repair directory index for key '%s'", trimmedKey)
-				}
+			// refresh the Redis lock
+			err := lock.Refresh(ctx, lockTTL, nil)
+			if err == redislock.ErrNotObtained {
+				// lock was lost (expired or released externally), stop refreshing
+				return
 			}
-
-			// End of results reached
-			if nextPointer == 0 {
-				break
+			if err != nil && rs.logger != nil {
+				rs.logger.Warnw("Failed to refresh lock, will retry", "key", key, "error", err)
 			}
-			pointer = nextPointer
 		}
-	}
+	}(refreshCtx, lock)
+}
 
-	// Obtain range of all direct children stored in the Sorted Set
-	keys, err := rs.client.ZRange(ctx, currKey, 0, -1).Result()
-	if err != nil {
-		return fmt.Errorf("Unable to get range on sorted set '%s': %v", currKey, err)
-	}
+func (rs *RedisStorage) Unlock(ctx context.Context, name string) error {
 
-	// Iterate over each child key
-	for _, k := range keys {
-		// Directory keys will have a "/" suffix
-		trimmedKey := strings.TrimSuffix(k, keyPathSeparator)
+	key := rs.prefixLock(name)
 
-		// Reconstruct the full path of child key
-		fullPathKey := path.Join(dir, trimmedKey)
+	// load and delete lock from sync.Map
+	if syncMapLock, loaded := rs.locks.LoadAndDelete(key); loaded {
 
-		// Remove key from set if it does not exist
-		exists, err := rs.existsKey(ctx, fullPathKey)
-		if err != nil {
-			return err
-		}
-		if !exists {
-			if err := rs.client.ZRem(ctx, currKey, k).Err(); err != nil {
-				return fmt.Errorf("Unable to remove stale record '%s' from directory '%s': %v", k, currKey, err)
-			}
-			if rs.logger != nil {
-				rs.logger.Infof("Removed non-existent record '%s' from directory '%s'", k, currKey)
-			}
-			continue
-		}
+		// type assertion for held lock
+		if lock, ok := syncMapLock.(heldLock); ok {
+			lock.cancel()
 
-		// If current key is a directory
-		if k != trimmedKey {
-			// Recursively traverse all child directories
-			if err := rs.Repair(ctx, fullPathKey); err != nil {
-				return err
+			// release the Redis lock
+			if err := lock.lock.Release(ctx); err != nil {
+				return fmt.Errorf("Unable to release lock for %s: %v", key, err)
 			}
 		}
 	}
@@ -698,12 +958,27 @@ func (rs *RedisStorage) Repair(ctx context.Context, dir string) error {
 	return nil
 }
 
+// isInternalKey reports whether the Redis key is used internally by this module rather than
+// storing a value, such as the expiry index or the time of the last background repair.
+func (rs *RedisStorage) isInternalKey(key string) bool {
+	return strings.HasPrefix(key, rs.KeyPrefix+":")
+}
+
 func (rs *RedisStorage) trimKey(key string) string {
 	return strings.TrimPrefix(strings.TrimPrefix(key, rs.KeyPrefix), keyPathSeparator)
 }
 
 func (rs *RedisStorage) prefixKey(key string) string {
-	return path.Join(rs.KeyPrefix, key)
+	return path.Join(rs.KeyPrefix, rs.encodeKeyPath(key))
+}
+
+// storageKeyPattern returns the glob-style pattern matching the keys stored under the key prefix,
+// excluding keys of other applications sharing the prefix, such as "<prefix>-sessions".
+func (rs *RedisStorage) storageKeyPattern() string {
+	if rs.KeyPrefix == "" {
+		return "*"
+	}
+	return escapeGlobPattern(rs.KeyPrefix) + keyPathSeparator + "*"
 }
 
 func (rs *RedisStorage) prefixLock(key string) string {
@@ -712,23 +987,18 @@ func (rs *RedisStorage) prefixLock(key string) string {
 
 func (rs RedisStorage) loadStorageData(ctx context.Context, key string) (*StorageData, error) {
 
-	data, err := rs.client.Get(ctx, rs.prefixKey(key)).Bytes()
-	if data == nil || errors.Is(err, redis.Nil) {
-		return nil, fs.ErrNotExist
+	sd, err := rs.readStorageData(ctx, rs.client, rs.prefixKey(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, err
 	} else if err != nil {
 		return nil, fmt.Errorf("Unable to get data for %s: %v", key, err)
 	}
 
-	sd := &StorageData{}
-	if err := json.Unmarshal(data, sd); err != nil {
-		return nil, fmt.Errorf("Unable to unmarshal value for %s: %v", key, err)
-	}
-
 	return sd, nil
 }
 
 // Store directory index in Redis ZSet structure for fast and efficient traversal in List()
-func (rs RedisStorage) storeDirectoryRecord(ctx context.Context, key string, score float64, repair, baseIsDir bool) error {
+func (rs RedisStorage) storeDirectoryRecord(ctx context.Context, key string, score float64, baseIsDir bool) error {
 
 	// Extract parent directory and base (file) names from key
 	dir, base := rs.splitDirectoryKey(key, baseIsDir)
@@ -744,15 +1014,10 @@ func (rs RedisStorage) storeDirectoryRecord(ctx context.Context, key string, sco
 	}
 
 	// Non-zero success means base was added to the set (not already there)
-	if success > 0 || repair {
-		if success > 0 && repair {
-			if rs.logger != nil {
-				rs.logger.Infof("Repaired index for record '%s' in directory '%s'", base, dir)
-			}
-		}
+	if success > 0 {
 		// recursively create parent directory until already
 		// created (success == 0) or top level reached
-		if err := rs.storeDirectoryRecord(ctx, dir, score, repair, true); err != nil {
+		if err := rs.storeDirectoryRecord(ctx, dir, score, true); err != nil {
 			return err
 		}
 	}
@@ -790,6 +1055,69 @@ func (rs RedisStorage) deleteDirectoryRecord(ctx context.Context, key string, ba
 	return nil
 }
 
+// deleteAbsentRecordScript removes member ARGV[1] from the directory Sorted Set KEYS[2], and KEYS[1]
+// from the expiry index KEYS[3] if given, only while KEYS[1] does not exist. Returns -1 if KEYS[1]
+// exists, otherwise 1 if KEYS[2] still exists or 0 if it was emptied.
+var deleteAbsentRecordScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return -1
+end
+if KEYS[3] then
+	redis.call('ZREM', KEYS[3], KEYS[1])
+end
+redis.call('ZREM', KEYS[2], ARGV[1])
+return redis.call('EXISTS', KEYS[2])
+`)
+
+// deleteAbsentDirectoryRecord removes key from the directory index, and from the expiry index if
+// TTL patterns are configured, pruning emptied parent directories. Each record is removed atomically
+// only while the key or directory does not exist, so records of keys stored concurrently are kept.
+// Returns false if key exists. Scripts cannot access keys in different hash slots, so in cluster
+// mode the existence is checked before removing records.
+func (rs RedisStorage) deleteAbsentDirectoryRecord(ctx context.Context, key string, baseIsDir bool) (bool, error) {
+
+	if rs.isCluster() {
+		exists, err := rs.existsRawKey(ctx, key)
+		if err != nil || exists {
+			return false, err
+		}
+		if err := rs.deleteDirectoryRecord(ctx, key, baseIsDir); err != nil {
+			return false, err
+		}
+		if !baseIsDir && len(rs.TTL) > 0 {
+			return true, rs.recordExpiry(ctx, key, 0)
+		}
+		return true, nil
+	}
+
+	dir, base := rs.splitDirectoryKey(key, baseIsDir)
+	// Reached the top-level directory
+	if dir == "." {
+		return true, nil
+	}
+
+	keys := []string{key, dir}
+	if !baseIsDir && len(rs.TTL) > 0 {
+		keys = append(keys, rs.expiryIndexKey())
+	}
+	result, err := deleteAbsentRecordScript.Run(ctx, rs.client, keys, base).Int()
+	if err != nil {
+		return false, fmt.Errorf("Unable to remove %s from Set %s: %v", base, dir, err)
+	}
+
+	switch result {
+	case -1:
+		return false, nil
+	case 0:
+		// Recursively delete parent directory emptied by the removal
+		if _, err := rs.deleteAbsentDirectoryRecord(ctx, dir, true); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
 func (rs RedisStorage) splitDirectoryKey(key string, baseIsDir bool) (string, string) {
 
 	dir := path.Dir(key)
@@ -15,19 +15,25 @@
 package storageredis
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"io/fs"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis/v2"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 const (
@@ -90,6 +96,46 @@ func TestRedisStorage_Store(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRedisStorage_StoreExceedsMaxValueSize(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+	rs.MaxValueSize = strconv.Itoa(len(TestValueCrt) - 1)
+
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "exceeds limit")
+	assert.False(t, rs.Exists(ctx, TestKeyExampleCrt))
+
+	rs.MaxValueSize = strconv.Itoa(len(TestValueCrt))
+	err = rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	assert.NoError(t, err)
+}
+
+func TestRedisStorage_StoreCompressionMinSize(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+	largeValue := bytes.Repeat(TestValueKey, 4)
+	rs.CompressionMinSize = strconv.Itoa(len(largeValue))
+
+	// Smaller than the minimum size: stored uncompressed
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	assert.NoError(t, err)
+	sd, err := rs.loadStorageData(ctx, TestKeyExampleCrt)
+	assert.NoError(t, err)
+	assert.Equal(t, storageCompressionNone, sd.Compression)
+
+	// At the minimum size: stored compressed
+	err = rs.Store(ctx, TestKeyExampleKey, largeValue)
+	assert.NoError(t, err)
+	sd, err = rs.loadStorageData(ctx, TestKeyExampleKey)
+	assert.NoError(t, err)
+	assert.Equal(t, storageCompressionFlate, sd.Compression)
+
+	loadedValue, err := rs.Load(ctx, TestKeyExampleCrt)
+	assert.NoError(t, err)
+	assert.Equal(t, TestValueCrt, loadedValue)
+}
+
 func TestRedisStorage_Exists(t *testing.T) {
 
 	rs, ctx := provisionRedisStorage(t)
@@ -104,6 +150,36 @@ func TestRedisStorage_Exists(t *testing.T) {
 	assert.True(t, exists)
 }
 
+func TestRedisStorage_ExistsWithError(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	assert.NoError(t, err)
+
+	// Directories exist while they have children
+	exists, err := rs.ExistsWithError(ctx, TestKeyCertPath)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.True(t, rs.Exists(ctx, TestKeyExamplePath))
+
+	exists, err = rs.ExistsWithError(ctx, TestKeyExampleKey)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// Redis failures are reported rather than treated as absent
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = rs.ExistsWithError(canceledCtx, TestKeyExampleCrt)
+	assert.ErrorContains(t, err, "Unable to check existence")
+	assert.False(t, rs.Exists(canceledCtx, TestKeyExampleCrt))
+
+	err = rs.client.RPush(ctx, rs.prefixKey("invalid"), "value").Err()
+	assert.NoError(t, err)
+	_, err = rs.ExistsWithError(ctx, "invalid")
+	assert.ErrorContains(t, err, "Unexpected type list")
+}
+
 func TestRedisStorage_Load(t *testing.T) {
 
 	rs, ctx := provisionRedisStorage(t)
@@ -117,6 +193,181 @@ func TestRedisStorage_Load(t *testing.T) {
 	assert.Equal(t, TestValueCrt, loadedValue)
 }
 
+func TestRedisStorage_LoadMixedEncryptionAlgorithms(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	assert.NoError(t, err)
+
+	rs.EncryptionAlgorithm = EncryptionXChaCha20Poly1305
+	err = rs.Store(ctx, TestKeyExampleKey, TestValueKey)
+	assert.NoError(t, err)
+
+	sd, err := rs.loadStorageData(ctx, TestKeyExampleCrt)
+	assert.NoError(t, err)
+	assert.Equal(t, storageEncryptionAESGCM, sd.Encryption)
+
+	sd, err = rs.loadStorageData(ctx, TestKeyExampleKey)
+	assert.NoError(t, err)
+	assert.Equal(t, storageEncryptionXChaCha20Poly1305, sd.Encryption)
+
+	loadedValue, err := rs.Load(ctx, TestKeyExampleCrt)
+	assert.NoError(t, err)
+	assert.Equal(t, TestValueCrt, loadedValue)
+
+	loadedValue, err = rs.Load(ctx, TestKeyExampleKey)
+	assert.NoError(t, err)
+	assert.Equal(t, TestValueKey, loadedValue)
+}
+
+func TestRedisStorage_LoadMixedValueFormats(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	rs.ValueFormat = ValueFormatJSON
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	assert.NoError(t, err)
+
+	rs.ValueFormat = ValueFormatBinary
+	err = rs.Store(ctx, TestKeyExampleKey, TestValueKey)
+	assert.NoError(t, err)
+
+	data, err := rs.client.Get(ctx, rs.prefixKey(TestKeyExampleCrt)).Bytes()
+	assert.NoError(t, err)
+	assert.Equal(t, byte('{'), data[0])
+
+	data, err = rs.client.Get(ctx, rs.prefixKey(TestKeyExampleKey)).Bytes()
+	assert.NoError(t, err)
+	assert.Equal(t, binaryEnvelopeMagic, data[0])
+
+	loadedValue, err := rs.Load(ctx, TestKeyExampleCrt)
+	assert.NoError(t, err)
+	assert.Equal(t, TestValueCrt, loadedValue)
+
+	loadedValue, err = rs.Load(ctx, TestKeyExampleKey)
+	assert.NoError(t, err)
+	assert.Equal(t, TestValueKey, loadedValue)
+}
+
+func TestRedisStorage_LoadCorruptedValue(t *testing.T) {
+
+	for _, layout := range []StorageLayout{StorageLayoutString, StorageLayoutHash} {
+		t.Run(string(layout), func(t *testing.T) {
+
+			rs, ctx := provisionRedisStorage(t)
+			// Without encryption or compression a flipped bit is otherwise undetectable
+			rs.EncryptionKey = ""
+			rs.Compression = CompressionNone
+			rs.StorageLayout = layout
+
+			err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+			require.NoError(t, err)
+
+			sd, err := rs.loadStorageData(ctx, TestKeyExampleCrt)
+			require.NoError(t, err)
+			require.NotEmpty(t, sd.Checksum)
+
+			// Flip a bit in the stored value
+			sd.Value[len(sd.Value)-1] ^= 0x01
+			_, err = rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				return rs.queueStorageData(ctx, pipe, rs.prefixKey(TestKeyExampleCrt), sd, 0)
+			})
+			require.NoError(t, err)
+
+			loadedValue, err := rs.Load(ctx, TestKeyExampleCrt)
+			assert.Nil(t, loadedValue)
+			assert.True(t, errors.Is(err, ErrChecksumMismatch))
+		})
+	}
+}
+
+func TestRedisStorage_EncryptedValueWithoutChecksum(t *testing.T) {
+
+	for _, layout := range []StorageLayout{StorageLayoutString, StorageLayoutHash} {
+		t.Run(string(layout), func(t *testing.T) {
+
+			rs, ctx := provisionRedisStorage(t)
+			rs.EncryptionKey = "oZO3BDDMuwC23croDwRr1aedfs5kcM8l"
+			rs.StorageLayout = layout
+
+			err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+			require.NoError(t, err)
+
+			// The checksum of the original value would be stored unencrypted
+			sd, err := rs.loadStorageData(ctx, TestKeyExampleCrt)
+			require.NoError(t, err)
+			assert.Empty(t, sd.Checksum)
+
+			// Corrupted values are detected by decryption
+			sd.Value[len(sd.Value)-1] ^= 0x01
+			_, err = rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				return rs.queueStorageData(ctx, pipe, rs.prefixKey(TestKeyExampleCrt), sd, 0)
+			})
+			require.NoError(t, err)
+
+			loadedValue, err := rs.Load(ctx, TestKeyExampleCrt)
+			assert.Nil(t, loadedValue)
+			assert.ErrorContains(t, err, "Unable to decrypt value")
+		})
+	}
+}
+
+func TestRedisStorage_LoadWithoutChecksum(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	// Values stored by earlier versions do not record a checksum
+	sd := &StorageData{Value: TestValueCrt, Modified: time.Now(), Size: int64(len(TestValueCrt))}
+	legacyValue, err := json.Marshal(sd)
+	require.NoError(t, err)
+	err = rs.client.Set(ctx, rs.prefixKey(TestKeyExampleCrt), legacyValue, 0).Err()
+	require.NoError(t, err)
+
+	loadedValue, err := rs.Load(ctx, TestKeyExampleCrt)
+	assert.NoError(t, err)
+	assert.Equal(t, TestValueCrt, loadedValue)
+}
+
+func TestRedisStorage_RepairVerifyChecksums(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+	rs.EncryptionKey = ""
+	rs.Compression = CompressionNone
+	core, logs := observer.New(zap.InfoLevel)
+	rs.logger = zap.New(core).Sugar()
+
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	require.NoError(t, err)
+	err = rs.Store(ctx, TestKeyExampleKey, TestValueKey)
+	require.NoError(t, err)
+
+	sd, err := rs.loadStorageData(ctx, TestKeyExampleCrt)
+	require.NoError(t, err)
+	sd.Value[0] ^= 0x01
+	data, err := rs.marshalStorageData(sd)
+	require.NoError(t, err)
+	err = rs.client.Set(ctx, rs.prefixKey(TestKeyExampleCrt), data, 0).Err()
+	require.NoError(t, err)
+
+	// Checksums are not verified by default
+	err = rs.Repair(ctx, "")
+	assert.NoError(t, err)
+	assert.Zero(t, logs.FilterMessageSnippet("Checksum verification failed").Len())
+
+	report, err := rs.RepairWithOptions(ctx, "", RepairOptions{VerifyChecksums: true})
+	assert.NoError(t, err)
+	failures := logs.FilterMessageSnippet("Checksum verification failed").All()
+	require.Len(t, failures, 1)
+	assert.Contains(t, failures[0].Message, TestKeyExampleCrt)
+	require.Len(t, report.UnreadableValues, 1)
+	assert.Equal(t, rs.prefixKey(TestKeyExampleCrt), report.UnreadableValues[0].Key)
+	assert.Contains(t, report.UnreadableValues[0].Error, ErrChecksumMismatch.Error())
+
+	// Corrupted values are reported but not modified
+	assert.True(t, rs.Exists(ctx, TestKeyExampleCrt))
+}
+
 func TestRedisStorage_Delete(t *testing.T) {
 
 	rs, ctx := provisionRedisStorage(t)
@@ -137,6 +388,39 @@ func TestRedisStorage_Delete(t *testing.T) {
 	assert.True(t, notExist)
 }
 
+func TestRedisStorage_DeleteDirectory(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+	rs.TTL = []KeyTTL{{Pattern: "certificates/*/*/*", TTL: caddy.Duration(time.Hour)}}
+
+	otherKey := TestKeyAcmePath + "/other.com/other.com.crt"
+	for _, key := range []string{TestKeyExampleCrt, TestKeyExampleKey, TestKeyExamplePath + "/sub/example.com.json", otherKey} {
+		err := rs.Store(ctx, key, TestValueCrt)
+		require.NoError(t, err)
+	}
+
+	err := rs.Delete(ctx, TestKeyExamplePath)
+	require.NoError(t, err)
+
+	// Values, directories and records in the parent directory are removed
+	assert.False(t, rs.Exists(ctx, TestKeyExamplePath))
+	assert.False(t, rs.Exists(ctx, TestKeyExampleCrt))
+	keys, err := rs.List(ctx, TestKeyAcmePath, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{TestKeyAcmePath + "/other.com"}, keys)
+	remaining, err := rs.client.Keys(ctx, rs.prefixKey(TestKeyExamplePath)+"*").Result()
+	require.NoError(t, err)
+	assert.Empty(t, remaining)
+	expiring, err := rs.client.ZRange(ctx, rs.expiryIndexKey(), 0, -1).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []string{rs.prefixKey(otherKey)}, expiring)
+
+	// Emptied parent directories are removed
+	err = rs.Delete(ctx, TestKeyAcmePath+"/other.com")
+	require.NoError(t, err)
+	assert.False(t, rs.Exists(ctx, TestKeyCertPath))
+}
+
 func TestRedisStorage_Stat(t *testing.T) {
 
 	rs, ctx := provisionRedisStorage(t)
@@ -153,6 +437,49 @@ func TestRedisStorage_Stat(t *testing.T) {
 	assert.Equal(t, TestKeyExampleCrt, stat.Key)
 	assert.WithinRange(t, stat.Modified, startTime, endTime)
 	assert.Equal(t, size, stat.Size)
+	assert.True(t, stat.IsTerminal)
+}
+
+func TestRedisStorage_StatDirectory(t *testing.T) {
+
+	for _, layout := range []StorageLayout{StorageLayoutString, StorageLayoutHash} {
+
+		rs, ctx := provisionRedisStorage(t)
+		rs.StorageLayout = layout
+
+		err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+		assert.NoError(t, err)
+		err = rs.Store(ctx, TestKeyExampleKey, TestValueKey)
+		assert.NoError(t, err)
+
+		// Directory records the most recent modification of its children
+		modified := time.Now().Add(time.Hour).Truncate(time.Second)
+		err = rs.storeDirectoryRecord(ctx, rs.prefixKey(TestKeyExampleKey), float64(modified.Unix()), false)
+		assert.NoError(t, err)
+
+		stat, err := rs.Stat(ctx, TestKeyExamplePath)
+		assert.NoError(t, err)
+		assert.Equal(t, TestKeyExamplePath, stat.Key)
+		assert.Equal(t, modified, stat.Modified)
+		assert.Zero(t, stat.Size)
+		assert.False(t, stat.IsTerminal)
+
+		// Subdirectory records hold the time a key was last created in the subdirectory,
+		// and are not updated when existing keys are stored again
+		created := time.Now().Add(-time.Hour).Truncate(time.Second)
+		err = rs.client.ZAdd(ctx, rs.prefixKey(TestKeyAcmePath), redis.Z{Score: float64(created.Unix()), Member: "example.com/"}).Err()
+		assert.NoError(t, err)
+		err = rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+		assert.NoError(t, err)
+
+		stat, err = rs.Stat(ctx, TestKeyAcmePath)
+		assert.NoError(t, err)
+		assert.Equal(t, created, stat.Modified)
+		assert.False(t, stat.IsTerminal)
+
+		_, err = rs.Stat(ctx, TestKeyAcmePath+"/missing")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	}
 }
 
 func TestRedisStorage_List(t *testing.T) {
@@ -279,6 +606,57 @@ func TestRedisStorage_ListNonRecursive(t *testing.T) {
 	assert.Contains(t, keys, TestKeyExampleJson)
 }
 
+func TestRedisStorage_EncryptKeyNames(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+	rs.EncryptKeyNames = true
+	require.NoError(t, rs.initKeyNameCipher())
+
+	err := rs.Store(ctx, TestKeyExampleCrt, TestValueCrt)
+	assert.NoError(t, err)
+
+	err = rs.Store(ctx, TestKeyExampleKey, TestValueKey)
+	assert.NoError(t, err)
+
+	// Neither value keys nor directory set members may reveal key names
+	redisKeys, err := rs.client.Keys(ctx, "*").Result()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, redisKeys)
+	for _, redisKey := range redisKeys {
+		assert.True(t, strings.HasPrefix(redisKey, TestKeyPrefix))
+		assert.NotContains(t, redisKey, "example.com")
+		assert.NotContains(t, redisKey, TestKeyCertPath)
+		if rs.client.Type(ctx, redisKey).Val() == "zset" {
+			members, err := rs.client.ZRange(ctx, redisKey, 0, -1).Result()
+			assert.NoError(t, err)
+			for _, member := range members {
+				assert.NotContains(t, member, "example.com")
+			}
+		}
+	}
+
+	loadedValue, err := rs.Load(ctx, TestKeyExampleCrt)
+	assert.NoError(t, err)
+	assert.Equal(t, TestValueCrt, loadedValue)
+
+	keys, err := rs.List(ctx, "", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{TestKeyExampleCrt, TestKeyExampleKey}, keys)
+
+	keys, err = rs.List(ctx, TestKeyAcmePath, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{TestKeyExamplePath}, keys)
+
+	// Repair must resolve encrypted names back to their plain keys
+	err = rs.Repair(ctx, "")
+	assert.NoError(t, err)
+
+	err = rs.Delete(ctx, TestKeyExampleCrt)
+	assert.NoError(t, err)
+	assert.False(t, rs.Exists(ctx, TestKeyExampleCrt))
+	assert.True(t, rs.Exists(ctx, TestKeyExampleKey))
+}
+
 func TestRedisStorage_LockUnlock(t *testing.T) {
 
 	rs, ctx := provisionRedisStorage(t)
@@ -290,6 +668,30 @@ func TestRedisStorage_LockUnlock(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRedisStorage_TryLock(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	obtained, err := rs.TryLock(ctx, TestKeyLock)
+	assert.NoError(t, err)
+	assert.True(t, obtained)
+
+	// Lock is already held
+	obtained, err = rs.TryLock(ctx, TestKeyLock)
+	assert.NoError(t, err)
+	assert.False(t, obtained)
+
+	err = rs.Unlock(ctx, TestKeyLock)
+	assert.NoError(t, err)
+
+	obtained, err = rs.TryLock(ctx, TestKeyLock)
+	assert.NoError(t, err)
+	assert.True(t, obtained)
+
+	err = rs.Unlock(ctx, TestKeyLock)
+	assert.NoError(t, err)
+}
+
 func TestRedisStorage_LockContention(t *testing.T) {
 
 	rs, ctx := provisionRedisStorage(t)
@@ -0,0 +1,218 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// Default key prefix of the gamalan/caddy-tlsredis module
+	defaultTLSRedisKeyPrefix = "caddytls"
+
+	// Default value prefix of the gamalan/caddy-tlsredis module
+	defaultTLSRedisValuePrefix = "caddy-storage-redis"
+
+	// Default AES key of the gamalan/caddy-tlsredis module
+	defaultTLSRedisAESKey = "redistls-01234567890-caddytls-32"
+)
+
+// TLSRedisMigrationOptions describe the configuration of the gamalan/caddy-tlsredis module
+// whose values are migrated by MigrateTLSRedis.
+type TLSRedisMigrationOptions struct {
+	// KeyPrefix of legacy keys, defaults to "caddytls"
+	KeyPrefix string
+	// ValuePrefix prepended to legacy values, defaults to "caddy-storage-redis"
+	ValuePrefix string
+	// AESKey used to encrypt legacy values, defaults to the legacy module default key
+	AESKey string
+	// Overwrite replaces keys already stored by this module
+	Overwrite bool
+	// Delete removes legacy keys once migrated
+	Delete bool
+}
+
+// tlsRedisStorageData is the format of values stored by the gamalan/caddy-tlsredis module
+type tlsRedisStorageData struct {
+	Value    []byte    `json:"value"`
+	Modified time.Time `json:"modified"`
+}
+
+// MigrateTLSRedis copies every value stored by the gamalan/caddy-tlsredis module into this
+// storage, preserving modification times and creating the directory index. Keys that cannot be
+// decoded, such as legacy locks, are logged and skipped. Returns the number of migrated keys.
+func (rs *RedisStorage) MigrateTLSRedis(ctx context.Context, opts TLSRedisMigrationOptions) (int, error) {
+
+	if opts.KeyPrefix == "" {
+		opts.KeyPrefix = defaultTLSRedisKeyPrefix
+	}
+	if opts.ValuePrefix == "" {
+		opts.ValuePrefix = defaultTLSRedisValuePrefix
+	}
+	if opts.AESKey == "" {
+		opts.AESKey = defaultTLSRedisAESKey
+	}
+	if opts.KeyPrefix == rs.KeyPrefix {
+		return 0, fmt.Errorf("Legacy key prefix must differ from key_prefix '%s'", rs.KeyPrefix)
+	}
+
+	var scanCount int64 = 500
+	var migrated atomic.Int64
+
+	// Keys are distributed across the master nodes in cluster mode
+	err := rs.forEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+
+		var pointer uint64 = 0
+
+		for {
+			// Scan for keys matching the legacy prefix and iterate until all found
+			keys, nextPointer, err := client.Scan(ctx, pointer, escapeGlobPattern(opts.KeyPrefix)+"*", scanCount).Result()
+			if err != nil {
+				return fmt.Errorf("Unable to scan path %s: %v", opts.KeyPrefix, err)
+			}
+
+			for _, legacyKey := range keys {
+				ok, err := rs.migrateTLSRedisKey(ctx, legacyKey, opts)
+				if err != nil {
+					return err
+				} else if ok {
+					migrated.Add(1)
+				}
+			}
+
+			// End of results reached
+			if nextPointer == 0 {
+				return nil
+			}
+			pointer = nextPointer
+		}
+	})
+
+	return int(migrated.Load()), err
+}
+
+// migrateTLSRedisKey stores the value of a single legacy key, returning false if it was skipped.
+func (rs *RedisStorage) migrateTLSRedisKey(ctx context.Context, legacyKey string, opts TLSRedisMigrationOptions) (bool, error) {
+
+	// Legacy keys are separated from the prefix by "/" or ":"
+	key := strings.TrimPrefix(legacyKey, opts.KeyPrefix)
+	if key == "" || (key[0] != '/' && key[0] != ':') {
+		return false, nil
+	}
+	key = key[1:]
+	if key == "" || strings.HasPrefix(key, "locks/") {
+		return false, nil
+	}
+
+	data, err := rs.client.Get(ctx, legacyKey).Bytes()
+	if errors.Is(err, redis.Nil) {
+		// Deleted concurrently
+		return false, nil
+	} else if err != nil {
+		if rs.logger != nil {
+			rs.logger.Warnf("Unable to migrate key '%s': %v", legacyKey, err)
+		}
+		return false, nil
+	}
+
+	legacy, err := decodeTLSRedisValue(data, opts.ValuePrefix, opts.AESKey)
+	if err != nil {
+		if rs.logger != nil {
+			rs.logger.Warnf("Unable to migrate key '%s': %v", legacyKey, err)
+		}
+		return false, nil
+	}
+
+	if !opts.Overwrite {
+		_, err := rs.loadStorageData(ctx, key)
+		if err == nil {
+			if rs.logger != nil {
+				rs.logger.Infof("Skipped key '%s' already stored as '%s'", legacyKey, key)
+			}
+			return false, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+	}
+
+	sd, err := rs.encodeStorageData(key, legacy.Value)
+	if err != nil {
+		return false, err
+	}
+	sd.Modified = legacy.Modified
+	if err := rs.storeStorageData(ctx, key, sd); err != nil {
+		return false, err
+	}
+
+	if opts.Delete {
+		if err := rs.client.Del(ctx, legacyKey).Err(); err != nil {
+			return false, fmt.Errorf("Unable to delete key %s: %v", legacyKey, err)
+		}
+	}
+
+	if rs.logger != nil {
+		rs.logger.Infof("Migrated key '%s' to '%s'", legacyKey, key)
+	}
+
+	return true, nil
+}
+
+// decodeTLSRedisValue decodes a value stored by the gamalan/caddy-tlsredis module: the JSON encoded
+// data prefixed with valuePrefix, encrypted using AES-GCM with the nonce prepended. Unencrypted
+// values are also accepted.
+func decodeTLSRedisValue(data []byte, valuePrefix, aesKey string) (*tlsRedisStorageData, error) {
+
+	if !bytes.HasPrefix(data, []byte(valuePrefix)) {
+		block, err := aes.NewCipher([]byte(aesKey))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid AES key: %v", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < aead.NonceSize() {
+			return nil, fmt.Errorf("Unable to decrypt value: data too short")
+		}
+		nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+		if data, err = aead.Open(nil, nonce, ciphertext, nil); err != nil {
+			return nil, fmt.Errorf("Unable to decrypt value: %v", err)
+		}
+	}
+
+	// Sanity check of the value prefix
+	if !bytes.HasPrefix(data, []byte(valuePrefix)) {
+		return nil, fmt.Errorf("Invalid value format")
+	}
+
+	legacy := &tlsRedisStorageData{}
+	if err := json.Unmarshal(data[len(valuePrefix):], legacy); err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal value: %v", err)
+	}
+
+	return legacy, nil
+}
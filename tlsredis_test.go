@@ -0,0 +1,105 @@
+// Copyright 2024 Pieter Berkel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageredis
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeTLSRedisValue encodes a value the same way as the gamalan/caddy-tlsredis module
+func encodeTLSRedisValue(t *testing.T, value []byte, modified time.Time, aesKey string) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(tlsRedisStorageData{Value: value, Modified: modified})
+	require.NoError(t, err)
+	data = append([]byte(defaultTLSRedisValuePrefix), data...)
+	if aesKey == "" {
+		return data
+	}
+
+	block, err := aes.NewCipher([]byte(aesKey))
+	require.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	require.NoError(t, err)
+	return aead.Seal(nonce, nonce, data, nil)
+}
+
+func TestRedisStorage_MigrateTLSRedis(t *testing.T) {
+
+	rs, ctx := provisionRedisStorage(t)
+
+	modified := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	legacy := map[string][]byte{
+		"caddytls/" + TestKeyExampleCrt: encodeTLSRedisValue(t, TestValueCrt, modified, defaultTLSRedisAESKey),
+		"caddytls/" + TestKeyExampleKey: encodeTLSRedisValue(t, TestValueKey, modified, defaultTLSRedisAESKey),
+		"caddytls/ocsp/example.com":     encodeTLSRedisValue(t, TestValueJson, modified, ""),
+		"caddytls/locks/example.com":    []byte("token"),
+		"caddytls/corrupt":              []byte("invalid"),
+	}
+	for key, value := range legacy {
+		err := rs.client.Set(ctx, key, value, 0).Err()
+		require.NoError(t, err)
+	}
+
+	// Keys already stored are kept unless overwritten
+	err := rs.Store(ctx, TestKeyExampleKey, TestValueJson)
+	require.NoError(t, err)
+
+	migrated, err := rs.MigrateTLSRedis(ctx, TLSRedisMigrationOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, migrated)
+
+	keys, err := rs.List(ctx, "", true)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{TestKeyExampleCrt, TestKeyExampleKey, "ocsp/example.com"}, keys)
+
+	value, err := rs.Load(ctx, TestKeyExampleCrt)
+	require.NoError(t, err)
+	assert.Equal(t, TestValueCrt, value)
+	stat, err := rs.Stat(ctx, TestKeyExampleCrt)
+	require.NoError(t, err)
+	assert.True(t, modified.Equal(stat.Modified))
+
+	value, err = rs.Load(ctx, TestKeyExampleKey)
+	require.NoError(t, err)
+	assert.Equal(t, TestValueJson, value)
+
+	migrated, err = rs.MigrateTLSRedis(ctx, TLSRedisMigrationOptions{Overwrite: true, Delete: true})
+	require.NoError(t, err)
+	assert.Equal(t, 3, migrated)
+
+	value, err = rs.Load(ctx, TestKeyExampleKey)
+	require.NoError(t, err)
+	assert.Equal(t, TestValueKey, value)
+
+	// Legacy keys that could not be migrated are left in place
+	remaining, err := rs.client.Keys(ctx, "caddytls*").Result()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"caddytls/locks/example.com", "caddytls/corrupt"}, remaining)
+
+	_, err = rs.MigrateTLSRedis(ctx, TLSRedisMigrationOptions{KeyPrefix: TestKeyPrefix})
+	assert.Error(t, err)
+}